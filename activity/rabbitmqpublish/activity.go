@@ -0,0 +1,158 @@
+package rabbitmqpublish
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"text/template"
+	"time"
+
+	"github.com/insrat/gf-plugins/internal/amqpconn"
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/log"
+	"github.com/streadway/amqp"
+)
+
+func init() {
+	_ = activity.Register(&Activity{}, New)
+}
+
+var activityMd = activity.ToMetadata(&Settings{}, &Input{})
+
+const (
+	defaultConfirmTimeout = 5 * time.Second
+	defaultContentType    = "application/json"
+)
+
+func New(ctx activity.InitContext) (activity.Activity, error) {
+	s := &Settings{}
+	err := metadata.MapToStruct(ctx.Settings(), s, true)
+	if err != nil {
+		return nil, err
+	}
+
+	routingKey, err := template.New("routingKey").Option("missingkey=error").Parse(s.RoutingKey)
+	if err != nil {
+		return nil, err
+	}
+	timeout := defaultConfirmTimeout
+	if s.ConfirmTimeout != "" {
+		if timeout, err = time.ParseDuration(s.ConfirmTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if s.ContentType == "" {
+		s.ContentType = defaultContentType
+	}
+
+	dial, err := amqpconn.DialAMQP(s.BrokerUrl, amqpconn.DialOptions{
+		CACertFile:     s.CACertFile,
+		ClientCertFile: s.ClientCertFile,
+		ClientKeyFile:  s.ClientKeyFile,
+		ServerName:     s.ServerName,
+		SASLExternal:   s.SASLExternal,
+		PasswordFile:   s.PasswordFile,
+		PasswordEnv:    s.PasswordEnv,
+		ConnectionName: s.ConnectionName,
+		Product:        "flogo-rabbitmqpublish",
+	})
+	if err != nil {
+		return nil, err
+	}
+	publisher := newPublisher(ctx.Logger(), s.Confirm, timeout)
+	conn := amqpconn.NewConnection(ctx.Logger(), dial, func(channel *amqp.Channel) error {
+		return publisher.setup(channel)
+	})
+	if err = conn.Start(); err != nil {
+		return nil, err
+	}
+
+	return &Activity{
+		settings:   s,
+		routingKey: routingKey,
+		conn:       conn,
+		publisher:  publisher,
+		logger:     ctx.Logger(),
+	}, nil
+}
+
+// Activity is a Counter Activity implementation
+type Activity struct {
+	settings   *Settings
+	routingKey *template.Template
+	conn       *amqpconn.Connection[*amqp.Channel]
+	publisher  *Publisher
+	logger     log.Logger
+}
+
+// Metadata implements activity.Activity.Metadata
+func (a *Activity) Metadata() *activity.Metadata {
+	return activityMd
+}
+
+// Eval implements activity.Activity.Eval
+func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
+	in := &Input{}
+	err = ctx.GetInputObject(in)
+	if err != nil {
+		return false, err
+	}
+
+	key, msg, err := a.message(in)
+	if err != nil {
+		return false, err
+	}
+	err = a.publisher.Publish(a.settings.ExchangeName, key, a.settings.Mandatory, msg)
+	if err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// Cleanup closes the connection when the app stops.
+func (a *Activity) Cleanup() error {
+	a.conn.Close()
+	return nil
+}
+
+// message builds the routing key and message of the input.
+func (a *Activity) message(in *Input) (string, amqp.Publishing, error) {
+	var key bytes.Buffer
+	if err := a.routingKey.Execute(&key, in.RoutingValues); err != nil {
+		return "", amqp.Publishing{}, err
+	}
+
+	var body []byte
+	switch v := in.Message.(type) {
+	case string:
+		body = []byte(v)
+	case []byte:
+		body = v
+	default:
+		var err error
+		if body, err = json.Marshal(v); err != nil {
+			return "", amqp.Publishing{}, err
+		}
+	}
+
+	deliveryMode := amqp.Transient
+	if a.settings.Persistent {
+		deliveryMode = amqp.Persistent
+	}
+	// Returns are matched to their message by its id.
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", amqp.Publishing{}, err
+	}
+	return key.String(), amqp.Publishing{
+		Headers:      amqp.Table(in.Headers),
+		ContentType:  a.settings.ContentType,
+		DeliveryMode: deliveryMode,
+		MessageId:    hex.EncodeToString(id),
+		Timestamp:    time.Now(),
+		Body:         body,
+	}, nil
+}
@@ -0,0 +1,62 @@
+package rabbitmqpublish
+
+import (
+	"testing"
+	"text/template"
+
+	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/support/test"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegister(t *testing.T) {
+
+	ref := activity.GetRef(&Activity{})
+	act := activity.Get(ref)
+
+	assert.NotNil(t, act)
+}
+
+func TestMessage(t *testing.T) {
+	a := &Activity{
+		settings:   &Settings{Persistent: true, ContentType: defaultContentType},
+		routingKey: template.Must(template.New("routingKey").Option("missingkey=error").Parse("scene.{{.sceneId}}.executed")),
+	}
+
+	key, msg, err := a.message(&Input{
+		Message:       map[string]interface{}{"sceneId": 12},
+		RoutingValues: map[string]interface{}{"sceneId": 12},
+		Headers:       map[string]interface{}{"source": "flogo"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "scene.12.executed", key)
+	assert.Equal(t, `{"sceneId":12}`, string(msg.Body))
+	assert.Equal(t, amqp.Persistent, msg.DeliveryMode)
+	assert.Equal(t, amqp.Table{"source": "flogo"}, msg.Headers)
+	assert.Len(t, msg.MessageId, 32)
+
+	_, msg, err = a.message(&Input{Message: "raw", RoutingValues: map[string]interface{}{"sceneId": 1}})
+	assert.Nil(t, err)
+	assert.Equal(t, "raw", string(msg.Body))
+
+	_, _, err = a.message(&Input{Message: "raw"})
+	assert.NotNil(t, err)
+}
+
+func TestNew_DialSettings(t *testing.T) {
+	// The dial settings are checked before connecting.
+	_, err := New(test.NewActivityInitContext(&Settings{
+		BrokerUrl:    "amqps://broker:5671/scene",
+		RoutingKey:   "scene.executed",
+		SASLExternal: true,
+	}, nil))
+	assert.EqualError(t, err, "SASL EXTERNAL requires a client certificate")
+
+	_, err = New(test.NewActivityInitContext(&Settings{
+		BrokerUrl:  "amqp://broker:5672/scene",
+		RoutingKey: "scene.executed",
+		CACertFile: "ca.pem",
+	}, nil))
+	assert.EqualError(t, err, "open ca.pem: no such file or directory")
+}
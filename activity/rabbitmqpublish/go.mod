@@ -0,0 +1,23 @@
+module github.com/insrat/gf-plugins/activity/rabbitmqpublish
+
+go 1.21.0
+
+require (
+	github.com/insrat/gf-plugins/internal/amqpconn v0.0.0
+	github.com/project-flogo/core v1.6.7
+	github.com/streadway/amqp v1.1.0
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/araddon/dateparse v0.0.0-20190622164848-0fb0a474d195 // indirect
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/kr/text v0.2.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	go.uber.org/zap v1.16.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
+
+replace github.com/insrat/gf-plugins/internal/amqpconn => ../../internal/amqpconn
@@ -0,0 +1,57 @@
+package rabbitmqpublish
+
+import (
+	"github.com/project-flogo/core/data/coerce"
+)
+
+type Settings struct {
+	BrokerUrl    string `md:"brokerUrl,required"`
+	ExchangeName string `md:"exchangeName"`
+	// RoutingKey is a text/template rendered with the routing values.
+	RoutingKey string `md:"routingKey,required"`
+	Persistent bool   `md:"persistent"`
+	Confirm    bool   `md:"confirm"`
+	// ConfirmTimeout bounds the wait for a confirm, e.g. 5s.
+	ConfirmTimeout string `md:"confirmTimeout"`
+	// Mandatory fails messages no queue is bound for, returns are only
+	// matched to their message with confirms enabled.
+	Mandatory   bool   `md:"mandatory"`
+	ContentType string `md:"contentType"`
+	// CACertFile, ClientCertFile and ClientKeyFile are PEM files for amqps.
+	CACertFile     string `md:"caCertFile"`
+	ClientCertFile string `md:"clientCertFile"`
+	ClientKeyFile  string `md:"clientKeyFile"`
+	ServerName     string `md:"serverName"`
+	// SASLExternal authenticates with the client certificate instead of a password.
+	SASLExternal bool `md:"saslExternal"`
+	// PasswordFile and PasswordEnv replace the password of the broker URL.
+	PasswordFile   string `md:"passwordFile"`
+	PasswordEnv    string `md:"passwordEnv"`
+	ConnectionName string `md:"connectionName"`
+}
+
+type Input struct {
+	Message       interface{}            `md:"message"`
+	RoutingValues map[string]interface{} `md:"routingValues"`
+	Headers       map[string]interface{} `md:"headers"`
+}
+
+// FromMap converts the values from a map into the struct Input
+func (i *Input) FromMap(values map[string]interface{}) (err error) {
+	i.Message = values["message"]
+	i.RoutingValues, err = coerce.ToObject(values["routingValues"])
+	if err != nil {
+		return
+	}
+	i.Headers, err = coerce.ToObject(values["headers"])
+	return
+}
+
+// ToMap converts the struct Input into a map
+func (i *Input) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"message":       i.Message,
+		"routingValues": i.RoutingValues,
+		"headers":       i.Headers,
+	}
+}
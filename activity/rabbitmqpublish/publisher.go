@@ -0,0 +1,226 @@
+package rabbitmqpublish
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/streadway/amqp"
+)
+
+// maxOutstanding bounds the messages waiting for their confirm, the
+// confirm and return channels are buffered for as many so that the
+// connection never blocks on handing them over.
+const maxOutstanding = 256
+
+// amqpChannel is the part of *amqp.Channel used here, so that tests can
+// run against a fake broker.
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+	Confirm(noWait bool) error
+	NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation
+	NotifyReturn(receiver chan amqp.Return) chan amqp.Return
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Publisher publishes through the channel of a supervised connection and,
+// with confirms enabled, waits for the broker to take each message.
+type Publisher struct {
+	confirm bool
+	timeout time.Duration
+	logger  log.Logger
+	// slots holds a token for every message waiting for its confirm.
+	slots chan struct{}
+
+	mu      sync.Mutex
+	session *session
+}
+
+// session tracks the confirms of one channel, delivery tags restart with
+// every channel.
+type session struct {
+	channel amqpChannel
+
+	// publishMu keeps the delivery tags in the order of the publishes. It is
+	// held across channel.Publish, which waits on the connection, so it
+	// must never be taken while handing over confirms.
+	publishMu sync.Mutex
+
+	mu      sync.Mutex
+	seq     uint64
+	pending map[uint64]*pending
+	returns map[string]amqp.Return
+	closed  bool
+}
+
+type pending struct {
+	messageID string
+	done      chan error
+}
+
+func newPublisher(logger log.Logger, confirm bool, timeout time.Duration) *Publisher {
+	return &Publisher{
+		confirm: confirm,
+		timeout: timeout,
+		logger:  logger,
+		slots:   make(chan struct{}, maxOutstanding),
+	}
+}
+
+// setup runs on every fresh channel of the connection.
+func (p *Publisher) setup(channel amqpChannel) error {
+	var confirms chan amqp.Confirmation
+	if p.confirm {
+		if err := channel.Confirm(false); err != nil {
+			return err
+		}
+		confirms = channel.NotifyPublish(make(chan amqp.Confirmation, maxOutstanding))
+	}
+	returns := channel.NotifyReturn(make(chan amqp.Return, maxOutstanding))
+
+	s := &session{
+		channel: channel,
+		pending: make(map[uint64]*pending),
+		returns: make(map[string]amqp.Return),
+	}
+	go p.dispatch(s, confirms, returns)
+
+	p.mu.Lock()
+	p.session = s
+	p.mu.Unlock()
+	return nil
+}
+
+// dispatch settles the pending messages of a session. A mandatory message
+// without a queue is returned before it is confirmed, so its return is
+// always recorded by the time its confirm arrives.
+func (p *Publisher) dispatch(s *session, confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for confirms != nil || returns != nil {
+		select {
+		case r, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			if !p.confirm {
+				p.logger.Warnf("message %s returned: %s", r.MessageId, r.ReplyText)
+				continue
+			}
+			s.mu.Lock()
+			s.returns[r.MessageId] = r
+			s.mu.Unlock()
+		case c, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			if s.settle(c) {
+				<-p.slots
+			}
+		}
+	}
+	for n := s.close(); n > 0; n-- {
+		<-p.slots
+	}
+}
+
+// settle hands the confirm to its message and reports whether it was
+// pending. The waiter may have timed out, done is buffered for that.
+func (s *session) settle(c amqp.Confirmation) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w, ok := s.pending[c.DeliveryTag]
+	if !ok {
+		return false
+	}
+	delete(s.pending, c.DeliveryTag)
+	r, returned := s.returns[w.messageID]
+	delete(s.returns, w.messageID)
+	switch {
+	case !c.Ack:
+		w.done <- fmt.Errorf("message %s was rejected by the broker", w.messageID)
+	case returned:
+		w.done <- fmt.Errorf("message %s was returned: %s", w.messageID, r.ReplyText)
+	default:
+		w.done <- nil
+	}
+	return true
+}
+
+// close fails the messages still waiting for the closed channel and
+// returns how many there were.
+func (s *session) close() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	n := len(s.pending)
+	for tag, w := range s.pending {
+		w.done <- fmt.Errorf("channel closed before message %s was confirmed", w.messageID)
+		delete(s.pending, tag)
+	}
+	return n
+}
+
+// Publish sends the message and waits for its confirm if confirms are enabled.
+func (p *Publisher) Publish(exchange, key string, mandatory bool, msg amqp.Publishing) error {
+	p.mu.Lock()
+	s := p.session
+	p.mu.Unlock()
+	if s == nil {
+		return fmt.Errorf("not connected to RabbitMQ")
+	}
+	if !p.confirm {
+		s.publishMu.Lock()
+		defer s.publishMu.Unlock()
+		return s.channel.Publish(exchange, key, mandatory, false, msg)
+	}
+
+	select {
+	case p.slots <- struct{}{}:
+	case <-time.After(p.timeout):
+		return fmt.Errorf("timed out waiting to publish message %s: too many messages waiting for confirms", msg.MessageId)
+	}
+
+	// The message is pending before it is published, so that its confirm
+	// always finds it.
+	s.publishMu.Lock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		s.publishMu.Unlock()
+		<-p.slots
+		return fmt.Errorf("not connected to RabbitMQ")
+	}
+	s.seq++
+	tag := s.seq
+	w := &pending{messageID: msg.MessageId, done: make(chan error, 1)}
+	s.pending[tag] = w
+	s.mu.Unlock()
+
+	err := s.channel.Publish(exchange, key, mandatory, false, msg)
+	if err != nil {
+		// The channel takes no delivery tag for a message it failed to send.
+		s.mu.Lock()
+		if _, ok := s.pending[tag]; ok {
+			delete(s.pending, tag)
+			s.seq--
+			<-p.slots
+		}
+		s.mu.Unlock()
+	}
+	s.publishMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// A message that timed out stays pending, it holds its slot until the
+	// broker confirms it or the channel closes.
+	select {
+	case err := <-w.done:
+		return err
+	case <-time.After(p.timeout):
+		return fmt.Errorf("timed out waiting for the confirm of message %s", w.messageID)
+	}
+}
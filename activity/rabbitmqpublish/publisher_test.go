@@ -0,0 +1,148 @@
+package rabbitmqpublish
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeChannel hands published messages to the test, which answers them on
+// the confirm and return channels as the broker would. Like the amqp
+// channel, it publishes under the lock that is held while a confirm is
+// handed over.
+type fakeChannel struct {
+	amqpChannel
+	mu        sync.Mutex
+	published chan amqp.Publishing
+	confirms  chan amqp.Confirmation
+	returns   chan amqp.Return
+}
+
+func newFakeChannel() *fakeChannel {
+	return &fakeChannel{published: make(chan amqp.Publishing, 1)}
+}
+
+func (c *fakeChannel) Confirm(noWait bool) error {
+	return nil
+}
+
+func (c *fakeChannel) NotifyPublish(confirm chan amqp.Confirmation) chan amqp.Confirmation {
+	c.confirms = confirm
+	return confirm
+}
+
+func (c *fakeChannel) NotifyReturn(receiver chan amqp.Return) chan amqp.Return {
+	c.returns = receiver
+	return receiver
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.published <- msg
+	return nil
+}
+
+func (c *fakeChannel) shutdown() {
+	close(c.confirms)
+	close(c.returns)
+}
+
+func publish(p *Publisher, id string) chan error {
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Publish("scene", "scene.1.executed", true, amqp.Publishing{MessageId: id})
+	}()
+	return done
+}
+
+func TestPublisher_Confirm(t *testing.T) {
+	p := newPublisher(log.RootLogger(), true, time.Second)
+	channel := newFakeChannel()
+	assert.Nil(t, p.setup(channel))
+
+	done := publish(p, "a")
+	<-channel.published
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	assert.Nil(t, <-done)
+
+	done = publish(p, "b")
+	<-channel.published
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	assert.EqualError(t, <-done, "message b was rejected by the broker")
+
+	// Unroutable mandatory messages are returned before they are confirmed.
+	done = publish(p, "c")
+	<-channel.published
+	channel.returns <- amqp.Return{MessageId: "c", ReplyText: "NO_ROUTE"}
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	assert.EqualError(t, <-done, "message c was returned: NO_ROUTE")
+
+	done = publish(p, "d")
+	<-channel.published
+	channel.shutdown()
+	assert.EqualError(t, <-done, "channel closed before message d was confirmed")
+	assert.EqualError(t, p.Publish("scene", "scene.1.executed", false, amqp.Publishing{}), "not connected to RabbitMQ")
+
+	// A fresh channel restarts the delivery tags.
+	channel = newFakeChannel()
+	assert.Nil(t, p.setup(channel))
+	done = publish(p, "e")
+	<-channel.published
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	assert.Nil(t, <-done)
+}
+
+func TestPublisher_ConfirmWhilePublishing(t *testing.T) {
+	p := newPublisher(log.RootLogger(), true, time.Second)
+	channel := newFakeChannel()
+	assert.Nil(t, p.setup(channel))
+
+	first := publish(p, "a")
+	<-channel.published
+	second := publish(p, "b")
+	<-channel.published
+
+	// The confirms of a and b are handed over while c waits to be published.
+	channel.mu.Lock()
+	third := publish(p, "c")
+	time.Sleep(10 * time.Millisecond)
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: true}
+	channel.mu.Unlock()
+	assert.Nil(t, <-first)
+	assert.Nil(t, <-second)
+
+	<-channel.published
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: true}
+	assert.Nil(t, <-third)
+}
+
+func TestPublisher_Timeout(t *testing.T) {
+	p := newPublisher(log.RootLogger(), true, 10*time.Millisecond)
+	channel := newFakeChannel()
+	assert.Nil(t, p.setup(channel))
+
+	done := publish(p, "a")
+	<-channel.published
+	assert.EqualError(t, <-done, "timed out waiting for the confirm of message a")
+
+	// A late confirm still frees the slot of the message.
+	channel.confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	assert.Eventually(t, func() bool { return len(p.slots) == 0 }, time.Second, time.Millisecond)
+}
+
+func TestPublisher_NoConfirm(t *testing.T) {
+	p := newPublisher(log.RootLogger(), false, time.Second)
+	channel := newFakeChannel()
+	assert.Nil(t, p.setup(channel))
+	assert.Nil(t, channel.confirms)
+
+	done := publish(p, "a")
+	<-channel.published
+	assert.Nil(t, <-done)
+}
@@ -4,6 +4,8 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
+	"sort"
+	"strings"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -18,7 +20,7 @@ func init() {
 	_ = activity.Register(&Activity{}, New)
 }
 
-var activityMd = activity.ToMetadata(&Settings{}, &Output{})
+var activityMd = activity.ToMetadata(&Settings{}, &Input{}, &Output{})
 
 func New(ctx activity.InitContext) (activity.Activity, error) {
 	s := &Settings{}
@@ -34,18 +36,37 @@ func New(ctx activity.InitContext) (activity.Activity, error) {
 	db.SetMaxIdleConns(10)
 	db.SetMaxOpenConns(100)
 
-	sceneLock, err := newLock("scene_timing", s.RedisUrl)
+	rdb, err := newRedis("scene_timing", s.RedisUrl)
 	if err != nil {
 		return nil, err
 	}
+	sceneLock := newLock("scene_timing", rdb)
+	jitter := newJitter("scene_timing_jitter", rdb)
 
-	return &Activity{db: db, sceneLock: sceneLock, logger: ctx.Logger()}, nil
+	countdown := newCountdown("scene_timing_countdown", rdb)
+
+	calendars, err := newCalendars(db, s.CalendarFiles, s.DefaultCalendar)
+	if err != nil {
+		return nil, err
+	}
+	location := time.UTC
+	if s.Timezone != "" {
+		if location, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Activity{db: db, sceneLock: sceneLock, jitter: jitter, countdown: countdown, calendars: calendars, location: location, logger: ctx.Logger()}, nil
 }
 
 // Activity is a Counter Activity implementation
 type Activity struct {
 	db        *sql.DB
 	sceneLock *Lock
+	jitter    *Jitter
+	countdown *Countdown
+	calendars *Calendars
+	location  *time.Location
 	logger    log.Logger
 }
 
@@ -56,54 +77,256 @@ func (a *Activity) Metadata() *activity.Metadata {
 
 // Eval implements activity.Activity.Eval
 func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
-	sceneIDs, err := a.filterScenes()
+	in := &Input{}
+	err = ctx.GetInputObject(in)
+	if err != nil {
+		return false, err
+	}
+
+	output := &Output{}
+	var claimed []dueCountdown
+	switch in.Mode {
+	case "", modeEvaluate:
+		output.SceneIDs, claimed, err = a.filterScenes(in.Tick())
+	case modeCountdown:
+		output.DueTime, err = a.addCountdown(in)
+	case modePreview:
+		output.NextRuns, err = a.previewScene(in)
+	default:
+		err = fmt.Errorf("unsupported mode %s", in.Mode)
+	}
 	if err != nil {
 		return false, err
 	}
 
-	output := &Output{SceneIDs: sceneIDs}
 	err = ctx.SetOutputObject(output)
 	if err != nil {
+		// The countdowns fire on the next evaluation instead.
+		if restoreErr := a.countdown.Restore(claimed); restoreErr != nil {
+			a.logger.Errorf("failed to restore countdowns: %v", restoreErr)
+		}
 		return false, err
 	}
 
 	return true, nil
 }
 
-func (a *Activity) filterScenes() ([]interface{}, error) {
-	tt := time.Now().UTC()
+// filterScenes returns the scenes to run at tt and the countdowns claimed
+// for them, which are to be restored if the scenes cannot be handed off.
+func (a *Activity) filterScenes(tt time.Time) ([]interface{}, []dueCountdown, error) {
+	if err := a.calendars.Refresh(); err != nil {
+		a.logger.Errorf("failed to refresh calendars, keep the last loaded: %v", err)
+	}
+
+	filter, args := candidateFilter(tt)
+	schedules, err := a.loadSchedules(filter, args...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var matchIDs []int64
+	for _, schedule := range schedules {
+		// The first instance to pick a window minute stores it, the rest read it back.
+		schedule.Picker = a.jitter.Pick
+		ok, err := schedule.Matches(tt)
+		if err != nil {
+			a.logger.Errorf("failed to match scene %d timing: %v", schedule.SceneID, err)
+			continue
+		}
+		if ok {
+			matchIDs = append(matchIDs, schedule.SceneID)
+		}
+	}
+
+	countdowns, err := a.filterCountdowns(tt)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, countdown := range countdowns {
+		matchIDs = append(matchIDs, countdown.SceneID)
+	}
+
+	var sceneIDs []interface{}
+	sceneFlag := make(map[int64]struct{})
+	for _, id := range matchIDs {
+		if _, ok := sceneFlag[id]; ok {
+			continue
+		}
+		sceneFlag[id] = struct{}{}
+		if ok := a.sceneLock.Lock(id, tt); !ok {
+			continue
+		}
+		sceneIDs = append(sceneIDs, id)
+		// Multi-instance distributed processing
+		time.Sleep(100 * time.Millisecond)
+	}
+	a.logger.Infof("the number of timing %s %s scenes obtained is %d", tt.Format(time.DateTime), tt.Weekday(), len(sceneIDs))
+
+	return sceneIDs, countdowns, nil
+}
+
+// previewScene returns the next count run times of a scene in unix seconds,
+// including a pending countdown.
+func (a *Activity) previewScene(in *Input) ([]interface{}, error) {
+	if in.SceneID <= 0 {
+		return nil, fmt.Errorf("invalid preview scene %d", in.SceneID)
+	}
+	if in.Count <= 0 {
+		in.Count = 1
+	}
+	if in.Count > maxPreviewCount {
+		in.Count = maxPreviewCount
+	}
+	if err := a.calendars.Refresh(); err != nil {
+		a.logger.Errorf("failed to refresh calendars, keep the last loaded: %v", err)
+	}
+
+	schedules, err := a.loadSchedules("AND a.scene_id = ?", in.SceneID)
+	if err != nil {
+		return nil, err
+	}
 
-	rows, err := a.db.Query(fmt.Sprintf("SELECT DISTINCT a.scene_id FROM scene_condition_timing a "+
+	var runs []time.Time
+	if due, ok, err := a.countdown.Get(in.SceneID); err != nil {
+		return nil, err
+	} else if ok {
+		runs = append(runs, due)
+	}
+	for _, schedule := range schedules {
+		// Previews must not pin the window minutes of future days.
+		schedule.Picker = a.jitter.Peek
+		after := in.Tick()
+		for i := int64(0); i < in.Count; i++ {
+			next := schedule.Next(after)
+			if next.IsZero() {
+				break
+			}
+			runs = append(runs, next)
+			after = next
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].Before(runs[j]) })
+
+	var nextRuns []interface{}
+	for i := 0; i < len(runs) && int64(len(nextRuns)) < in.Count; i++ {
+		if i > 0 && runs[i].Equal(runs[i-1]) {
+			continue
+		}
+		nextRuns = append(nextRuns, runs[i].Unix())
+	}
+	return nextRuns, nil
+}
+
+// candidateFilter narrows the timing conditions to those that may fire at tt:
+// on the weekday or date of tt, or on calendar days, and at the minute of tt
+// or with a window or interval around it. Schedule.Matches decides on the rest.
+func candidateFilter(tt time.Time) (string, []interface{}) {
+	tt = tt.UTC()
+	return fmt.Sprintf("AND (a.schedule_type in ('workday', 'holiday') or a.execute_date = ? or a.%s = true) "+
+			"and ((a.execute_hour = ? and a.execute_minute = ?) or ((a.window_start is not null or a.schedule_type = 'interval') "+
+			"and (a.window_start is null or TIME(a.window_start) <= ?) and (a.window_end is null or TIME(a.window_end) >= ?)))",
+			shortDayNames[tt.Weekday()]),
+		[]interface{}{tt.Format(time.DateOnly), tt.Hour(), tt.Minute(), tt.Format("15:04") + ":59", tt.Format("15:04") + ":00"}
+}
+
+// loadSchedules loads the timing conditions of open scenes, narrowed by an optional filter.
+func (a *Activity) loadSchedules(filter string, args ...interface{}) ([]*Schedule, error) {
+	rows, err := a.db.Query("SELECT a.id, a.scene_id, b.home_id, a.schedule_type, a.execute_hour, a.execute_minute, a.execute_date, "+
+		"a."+strings.Join(shortDayNames, ", a.")+", a.window_start, a.window_end, a.interval_minutes FROM scene_condition_timing a "+
 		"INNER JOIN scene_smart_auto_scene b ON b.id = a.scene_id AND b.deleted = false AND b.open = true "+
-		"WHERE a.deleted = false and a.execute_hour = ? and a.execute_minute = ? and (a.execute_date = ? or a.%s = true)",
-		shortDayNames[tt.Weekday()]),
-		tt.Hour(), tt.Minute(), tt.Format(time.DateOnly),
+		"WHERE a.deleted = false "+filter,
+		args...,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	var sceneIDs []interface{}
+	var schedules []*Schedule
+	for rows.Next() {
+		s := &Schedule{Location: a.location}
+		if err = rows.Scan(&s.TimingID, &s.SceneID, &s.HomeID, &s.ScheduleType, &s.ExecuteHour, &s.ExecuteMinute, &s.ExecuteDate,
+			&s.Weekdays[0], &s.Weekdays[1], &s.Weekdays[2], &s.Weekdays[3], &s.Weekdays[4], &s.Weekdays[5], &s.Weekdays[6],
+			&s.WindowStart, &s.WindowEnd, &s.Interval); err != nil {
+			return nil, err
+		}
+		s.Calendar = a.calendars.Get(s.HomeID)
+		schedules = append(schedules, s)
+	}
+	return schedules, rows.Err()
+}
+
+// filterCountdowns claims the countdowns due at tt of open scenes. Each
+// countdown is removed by exactly one instance, so it fires once across the
+// cluster, and only once its scene was looked up, so that a failed lookup
+// leaves it for the next evaluation. Countdowns of closed or deleted scenes
+// are dropped.
+func (a *Activity) filterCountdowns(tt time.Time) ([]dueCountdown, error) {
+	due, err := a.countdown.Due(tt)
+	if err != nil {
+		return nil, err
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	dueIDs := make([]int64, len(due))
+	for i, d := range due {
+		dueIDs[i] = d.SceneID
+	}
+	rows, err := a.db.Query(fmt.Sprintf("SELECT id FROM scene_smart_auto_scene "+
+		"WHERE deleted = false AND open = true AND id in (%s)",
+		intSliceToString(dueIDs),
+	))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	open := make(map[int64]bool)
 	for rows.Next() {
 		var id int64
 		if err = rows.Scan(&id); err != nil {
 			return nil, err
 		}
-		if ok := a.sceneLock.Lock(id); !ok {
-			continue
+		open[id] = true
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var claimed []dueCountdown
+	for _, d := range due {
+		ok, err := a.countdown.Claim(d)
+		if err != nil {
+			if restoreErr := a.countdown.Restore(claimed); restoreErr != nil {
+				a.logger.Errorf("failed to restore countdowns: %v", restoreErr)
+			}
+			return nil, err
+		}
+		if ok && open[d.SceneID] {
+			claimed = append(claimed, d)
 		}
-		sceneIDs = append(sceneIDs, id)
-		// Multi-instance distributed processing
-		time.Sleep(100 * time.Millisecond)
 	}
-	a.logger.Infof("the number of timing %s %s scenes obtained is %d", tt.Format(time.DateTime), tt.Weekday(), len(sceneIDs))
+	return claimed, nil
+}
 
-	return sceneIDs, nil
+// addCountdown schedules a one-shot run of the scene delay minutes after the tick.
+func (a *Activity) addCountdown(in *Input) (int64, error) {
+	if in.SceneID <= 0 || in.Delay <= 0 {
+		return 0, fmt.Errorf("invalid countdown of %d minutes for scene %d", in.Delay, in.SceneID)
+	}
+	due := in.Tick().Add(time.Duration(in.Delay) * time.Minute)
+	if err := a.countdown.Add(in.SceneID, due); err != nil {
+		return 0, err
+	}
+	a.logger.Infof("add scene %d countdown due at %s successfully", in.SceneID, due.Format(time.DateTime))
+	return due.Unix(), nil
 }
 
 var (
-	lockExpiration = 1 * time.Minute
+	lockExpiration   = 1 * time.Minute
+	jitterExpiration = 48 * time.Hour
 )
 
 type Lock struct {
@@ -111,7 +334,9 @@ type Lock struct {
 	rdb  *redis.Client
 }
 
-func newLock(name string, url string) (*Lock, error) {
+// newRedis connects to Redis and checks that it takes writes, the client
+// is shared by the lock, jitter and countdown of the activity.
+func newRedis(name string, url string) (*redis.Client, error) {
 	opt, err := redis.ParseURL(url)
 	if err != nil {
 		return nil, err
@@ -122,11 +347,125 @@ func newLock(name string, url string) (*Lock, error) {
 		return nil, err
 	}
 	rdb.Del(context.Background(), name)
-	return &Lock{name: name, rdb: rdb}, nil
+	return rdb, nil
 }
 
-func (c *Lock) Lock(key int64) bool {
-	cmd := c.rdb.SetNX(context.Background(), fmt.Sprintf("%s:%d", c.name, key), time.Now().String(), lockExpiration)
+func newLock(name string, rdb *redis.Client) *Lock {
+	return &Lock{name: name, rdb: rdb}
+}
+
+// Lock claims the scene for the minute of tt, so that only one instance
+// runs it per tick while runs in the following minutes are not held back.
+func (c *Lock) Lock(key int64, tt time.Time) bool {
+	cmd := c.rdb.SetNX(context.Background(), fmt.Sprintf("%s:%d:%d", c.name, key, tt.Truncate(time.Minute).Unix()), time.Now().String(), lockExpiration)
 	ok, err := cmd.Result()
 	return ok && err == nil
 }
+
+type Jitter struct {
+	name string
+	rdb  *redis.Client
+}
+
+func newJitter(name string, rdb *redis.Client) *Jitter {
+	return &Jitter{name: name, rdb: rdb}
+}
+
+// Pick stores minute under key unless a value already exists and returns the
+// stored value. The given minute is kept when Redis is unavailable.
+func (c *Jitter) Pick(key string, minute int) int {
+	key = fmt.Sprintf("%s:%s", c.name, key)
+	if err := c.rdb.SetNX(context.Background(), key, minute, jitterExpiration).Err(); err != nil {
+		return minute
+	}
+	if stored, err := c.rdb.Get(context.Background(), key).Int(); err == nil {
+		return stored
+	}
+	return minute
+}
+
+// Peek returns the value stored under key without storing minute.
+func (c *Jitter) Peek(key string, minute int) int {
+	if stored, err := c.rdb.Get(context.Background(), fmt.Sprintf("%s:%s", c.name, key)).Int(); err == nil {
+		return stored
+	}
+	return minute
+}
+
+type Countdown struct {
+	name string
+	rdb  *redis.Client
+}
+
+func newCountdown(name string, rdb *redis.Client) *Countdown {
+	return &Countdown{name: name, rdb: rdb}
+}
+
+// Add schedules the scene at due, replacing any pending countdown of the scene.
+func (c *Countdown) Add(sceneID int64, due time.Time) error {
+	return c.rdb.ZAdd(context.Background(), c.name, redis.Z{Score: float64(due.Unix()), Member: fmt.Sprint(sceneID)}).Err()
+}
+
+// Get returns the due time of the pending countdown of the scene.
+func (c *Countdown) Get(sceneID int64) (time.Time, bool, error) {
+	score, err := c.rdb.ZScore(context.Background(), c.name, fmt.Sprint(sceneID)).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(int64(score), 0).UTC(), true, nil
+}
+
+// dueCountdown is a countdown of a scene due at Due.
+type dueCountdown struct {
+	SceneID int64
+	Due     time.Time
+}
+
+// Due returns the countdowns due at or before tt without removing them.
+func (c *Countdown) Due(tt time.Time) ([]dueCountdown, error) {
+	members, err := c.rdb.ZRangeByScoreWithScores(context.Background(), c.name, &redis.ZRangeBy{
+		Min: "-inf",
+		Max: fmt.Sprint(tt.Unix()),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	var due []dueCountdown
+	for _, member := range members {
+		var id int64
+		if _, err = fmt.Sscan(fmt.Sprint(member.Member), &id); err == nil {
+			due = append(due, dueCountdown{SceneID: id, Due: time.Unix(int64(member.Score), 0).UTC()})
+		}
+	}
+	return due, nil
+}
+
+// Claim removes the countdown. Only the caller whose ZREM succeeds claims
+// it, a countdown replaced in the meantime is left alone.
+func (c *Countdown) Claim(d dueCountdown) (bool, error) {
+	removed, err := claimScript.Run(context.Background(), c.rdb, []string{c.name}, fmt.Sprint(d.SceneID), d.Due.Unix()).Int()
+	return removed == 1, err
+}
+
+// Restore puts back claimed countdowns, unless their scenes got a new one.
+func (c *Countdown) Restore(due []dueCountdown) error {
+	for _, d := range due {
+		if err := c.rdb.ZAddNX(context.Background(), c.name, redis.Z{Score: float64(d.Due.Unix()), Member: fmt.Sprint(d.SceneID)}).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// claimScript removes a countdown member only while it still has the due
+// time it was read with.
+var claimScript = redis.NewScript(`
+if redis.call("ZSCORE", KEYS[1], ARGV[1]) == ARGV[2] then
+	return redis.call("ZREM", KEYS[1], ARGV[1])
+end
+return 0
+`)
@@ -1,10 +1,14 @@
 package scenetiming
 
 import (
+	"errors"
 	"testing"
 	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/support/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -38,3 +42,124 @@ func TestEvalNoMatch(t *testing.T) {
 	tc.GetOutputObject(output)
 	assert.True(t, len(output.SceneIDs) == 0)
 }
+
+func newTestActivity(t *testing.T) (*Activity, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	mr := miniredis.RunT(t)
+	rdb, err := newRedis("scene_timing", "redis://"+mr.Addr())
+	assert.Nil(t, err)
+	return &Activity{db: db, countdown: newCountdown("scene_timing_countdown", rdb), logger: log.RootLogger()}, mock, mr
+}
+
+func TestFilterCountdowns(t *testing.T) {
+	a, mock, _ := newTestActivity(t)
+	tick := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+	assert.Nil(t, a.countdown.Add(7, tick))
+	assert.Nil(t, a.countdown.Add(8, tick.Add(-time.Minute)))
+	assert.Nil(t, a.countdown.Add(9, tick.Add(time.Minute)))
+
+	// A failed lookup keeps the countdowns for the next evaluation.
+	mock.ExpectQuery("SELECT id FROM scene_smart_auto_scene").WillReturnError(errors.New("connection refused"))
+	_, err := a.filterCountdowns(tick)
+	assert.EqualError(t, err, "connection refused")
+	_, ok, err := a.countdown.Get(7)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+
+	// Scene 8 was closed, its countdown is dropped.
+	mock.ExpectQuery("SELECT id FROM scene_smart_auto_scene").WillReturnRows(sqlmock.NewRows([]string{"id"}).AddRow(7))
+	claimed, err := a.filterCountdowns(tick)
+	assert.Nil(t, err)
+	assert.Equal(t, []dueCountdown{{SceneID: 7, Due: tick}}, claimed)
+	for id, pending := range map[int64]bool{7: false, 8: false, 9: true} {
+		_, ok, err = a.countdown.Get(id)
+		assert.Nil(t, err)
+		assert.Equal(t, pending, ok, "scene %d", id)
+	}
+	assert.Nil(t, mock.ExpectationsWereMet())
+
+	// Claimed countdowns go back when the scenes cannot be handed off.
+	assert.Nil(t, a.countdown.Restore(claimed))
+	due, ok, err := a.countdown.Get(7)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, tick, due)
+}
+
+func TestCountdown_Claim(t *testing.T) {
+	a, _, _ := newTestActivity(t)
+	tick := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+	assert.Nil(t, a.countdown.Add(7, tick))
+	due, err := a.countdown.Due(tick)
+	assert.Nil(t, err)
+
+	// A countdown replaced after it was read is not claimed.
+	assert.Nil(t, a.countdown.Add(7, tick.Add(time.Hour)))
+	ok, err := a.countdown.Claim(due[0])
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	due, err = a.countdown.Due(tick.Add(time.Hour))
+	assert.Nil(t, err)
+	ok, err = a.countdown.Claim(due[0])
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	ok, err = a.countdown.Claim(due[0])
+	assert.Nil(t, err)
+	assert.False(t, ok)
+}
+
+func TestLoadSchedules_Candidates(t *testing.T) {
+	a, mock, _ := newTestActivity(t)
+	a.calendars = &Calendars{}
+
+	// Friday 07:30 UTC.
+	tt := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+	columns := []string{"id", "scene_id", "home_id", "schedule_type", "execute_hour", "execute_minute", "execute_date",
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat", "window_start", "window_end", "interval_minutes"}
+	mock.ExpectQuery(`WHERE a.deleted = false AND \(a.schedule_type in \('workday', 'holiday'\) or a.execute_date = \? or a.fri = true\)`).
+		WithArgs("2024-03-01", 7, 30, "07:30:59", "07:30:00").
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 10, 100, nil, 7, 30, nil, 0, 1, 1, 1, 1, 1, 0, nil, nil, nil))
+
+	filter, args := candidateFilter(tt)
+	schedules, err := a.loadSchedules(filter, args...)
+	assert.Nil(t, err)
+	assert.Len(t, schedules, 1)
+	ok, err := schedules[0].Matches(tt)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestLock_PerTick(t *testing.T) {
+	mr := miniredis.RunT(t)
+	rdb, err := newRedis("scene_timing", "redis://"+mr.Addr())
+	assert.Nil(t, err)
+	lock := newLock("scene_timing", rdb)
+
+	tt := time.Date(2024, 3, 1, 7, 30, 0, 0, time.UTC)
+	assert.True(t, lock.Lock(7, tt))
+	assert.False(t, lock.Lock(7, tt.Add(30*time.Second)))
+	// The next minute is not held back by the lock of this one.
+	assert.True(t, lock.Lock(7, tt.Add(time.Minute)))
+	assert.True(t, lock.Lock(8, tt))
+}
+
+func TestPreviewScene_MaxCount(t *testing.T) {
+	a, mock, _ := newTestActivity(t)
+	a.calendars = &Calendars{loadedAt: time.Now()}
+
+	columns := []string{"id", "scene_id", "home_id", "schedule_type", "execute_hour", "execute_minute", "execute_date",
+		"sun", "mon", "tue", "wed", "thu", "fri", "sat", "window_start", "window_end", "interval_minutes"}
+	mock.ExpectQuery("SELECT a.id, a.scene_id").WithArgs(10).
+		WillReturnRows(sqlmock.NewRows(columns).
+			AddRow(1, 10, 100, scheduleInterval, nil, nil, nil, 1, 1, 1, 1, 1, 1, 1, nil, nil, 1))
+
+	runs, err := a.previewScene(&Input{SceneID: 10, Count: 1000000, TickTime: time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC).Unix()})
+	assert.Nil(t, err)
+	assert.Len(t, runs, maxPreviewCount)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
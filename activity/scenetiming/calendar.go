@@ -0,0 +1,273 @@
+package scenetiming
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var calendarRefresh = 10 * time.Minute
+
+// Calendar holds the dates that override the default Monday to Friday work week.
+type Calendar struct {
+	Name string
+	// Days maps a date in time.DateOnly format to whether it is a workday.
+	Days map[string]bool
+}
+
+// IsWorkday reports whether the date of t is a workday in the calendar.
+func (c *Calendar) IsWorkday(t time.Time) bool {
+	if c != nil {
+		if workday, ok := c.Days[t.Format(time.DateOnly)]; ok {
+			return workday
+		}
+	}
+	return t.Weekday() != time.Saturday && t.Weekday() != time.Sunday
+}
+
+// Matches reports whether a schedule type applies on the date of t.
+func (c *Calendar) Matches(scheduleType string, t time.Time) bool {
+	switch scheduleType {
+	case scheduleWorkday:
+		return c.IsWorkday(t)
+	case scheduleHoliday:
+		return !c.IsWorkday(t)
+	}
+	return false
+}
+
+// ParseICS reads all-day events from an iCalendar stream. Events with a
+// WORKDAY category are adjusted working days, all others are holidays.
+func ParseICS(name string, r io.Reader) (*Calendar, error) {
+	cal := &Calendar{Name: name, Days: make(map[string]bool)}
+
+	var lines []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimRight(scanner.Text(), "\r")
+		// Unfold continuation lines.
+		if len(lines) > 0 && (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	var inEvent, workday bool
+	var start, end time.Time
+	for _, line := range lines {
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, _, _ := strings.Cut(key, ";")
+		switch strings.ToUpper(prop) {
+		case "BEGIN":
+			if strings.EqualFold(value, "VEVENT") {
+				inEvent, workday = true, false
+				start, end = time.Time{}, time.Time{}
+			}
+		case "DTSTART":
+			if inEvent {
+				start = parseICSDate(value)
+			}
+		case "DTEND":
+			if inEvent {
+				end = parseICSDate(value)
+			}
+		case "CATEGORIES":
+			if inEvent {
+				for _, category := range strings.Split(value, ",") {
+					if strings.EqualFold(strings.TrimSpace(category), scheduleWorkday) {
+						workday = true
+					}
+				}
+			}
+		case "END":
+			if !inEvent || !strings.EqualFold(value, "VEVENT") {
+				continue
+			}
+			inEvent = false
+			if start.IsZero() {
+				continue
+			}
+			// DTEND is exclusive, a missing one means a single day.
+			if !end.After(start) {
+				end = start.AddDate(0, 0, 1)
+			}
+			for day := start; day.Before(end); day = day.AddDate(0, 0, 1) {
+				cal.Days[day.Format(time.DateOnly)] = workday
+			}
+		}
+	}
+
+	return cal, nil
+}
+
+func parseICSDate(value string) time.Time {
+	if len(value) < 8 {
+		return time.Time{}
+	}
+	t, err := time.Parse("20060102", value[:8])
+	if err != nil {
+		return time.Time{}
+	}
+	return t
+}
+
+// Calendars loads holiday and workday overrides from MySQL and iCalendar
+// files and resolves the calendar selected by each home.
+type Calendars struct {
+	db              *sql.DB
+	files           map[string]string
+	defaultCalendar string
+
+	mu        sync.RWMutex
+	calendars map[string]*Calendar
+	homes     map[int64]string
+	loadedAt  time.Time
+	// parsed holds the last version of each calendar file that was read.
+	parsed map[string]*Calendar
+}
+
+func newCalendars(db *sql.DB, files string, defaultCalendar string) (*Calendars, error) {
+	c := &Calendars{db: db, files: make(map[string]string), defaultCalendar: defaultCalendar, parsed: make(map[string]*Calendar)}
+	for _, file := range strings.Split(files, ",") {
+		if file = strings.TrimSpace(file); file == "" {
+			continue
+		}
+		name, path, ok := strings.Cut(file, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid calendar file %q, expected name=path", file)
+		}
+		c.files[strings.TrimSpace(name)] = strings.TrimSpace(path)
+	}
+	return c, nil
+}
+
+// Get returns the calendar selected by the home, or nil for the default work week.
+func (c *Calendars) Get(homeID int64) *Calendar {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	name, ok := c.homes[homeID]
+	if !ok {
+		name = c.defaultCalendar
+	}
+	return c.calendars[name]
+}
+
+// Refresh reloads all calendars once they are older than calendarRefresh.
+// The calendars last loaded stay in use when the database fails, and a
+// calendar file that cannot be read keeps its last version, so that one
+// broken calendar does not stop the evaluation of every home. The errors
+// are returned for logging.
+func (c *Calendars) Refresh() error {
+	c.mu.RLock()
+	fresh := time.Since(c.loadedAt) < calendarRefresh
+	c.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	var fileErrs []error
+	parsed := make(map[string]*Calendar)
+	for name, path := range c.files {
+		cal, err := parseICSFile(name, path)
+		if err != nil {
+			fileErrs = append(fileErrs, err)
+			continue
+		}
+		parsed[name] = cal
+	}
+	c.mu.Lock()
+	for name, cal := range parsed {
+		c.parsed[name] = cal
+	}
+	// The parsed calendars are copied, the overrides must not change them.
+	calendars := make(map[string]*Calendar)
+	for name, cal := range c.parsed {
+		days := make(map[string]bool, len(cal.Days))
+		for day, workday := range cal.Days {
+			days[day] = workday
+		}
+		calendars[name] = &Calendar{Name: name, Days: days}
+	}
+	c.mu.Unlock()
+
+	homes, err := c.loadOverrides(calendars)
+	if err != nil {
+		return errors.Join(append(fileErrs, err)...)
+	}
+
+	c.mu.Lock()
+	c.calendars, c.homes, c.loadedAt = calendars, homes, time.Now()
+	c.mu.Unlock()
+	return errors.Join(fileErrs...)
+}
+
+func parseICSFile(name, path string) (*Calendar, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cal, err := ParseICS(name, f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse calendar %s: %v", path, err)
+	}
+	return cal, nil
+}
+
+// loadOverrides applies the database days to the calendars, they take
+// precedence over calendar files, and returns the calendars of the homes.
+func (c *Calendars) loadOverrides(calendars map[string]*Calendar) (map[int64]string, error) {
+	rows, err := c.db.Query("SELECT calendar, day, workday FROM scene_calendar_day WHERE deleted = false")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name, day string
+		var workday bool
+		if err = rows.Scan(&name, &day, &workday); err != nil {
+			return nil, err
+		}
+		cal, ok := calendars[name]
+		if !ok {
+			cal = &Calendar{Name: name, Days: make(map[string]bool)}
+			calendars[name] = cal
+		}
+		if len(day) < len(time.DateOnly) {
+			return nil, fmt.Errorf("invalid calendar %s day %q", name, day)
+		}
+		cal.Days[day[:len(time.DateOnly)]] = workday
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	homeRows, err := c.db.Query("SELECT home_id, calendar FROM scene_home_calendar WHERE deleted = false")
+	if err != nil {
+		return nil, err
+	}
+	defer homeRows.Close()
+	homes := make(map[int64]string)
+	for homeRows.Next() {
+		var homeID int64
+		var name string
+		if err = homeRows.Scan(&homeID, &name); err != nil {
+			return nil, err
+		}
+		homes[homeID] = name
+	}
+	return homes, homeRows.Err()
+}
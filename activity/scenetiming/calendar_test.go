@@ -0,0 +1,87 @@
+package scenetiming
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/stretchr/testify/assert"
+)
+
+const testICS = "BEGIN:VCALENDAR\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20241001\r\n" +
+	"DTEND;VALUE=DATE:20241004\r\n" +
+	"SUMMARY:National Day\r\n" +
+	"END:VEVENT\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART;VALUE=DATE:20240929\r\n" +
+	"SUMMARY:Adjusted working\r\n" +
+	" day\r\n" +
+	"CATEGORIES:HOLIDAY,WORKDAY\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseICS(t *testing.T) {
+	cal, err := ParseICS("cn", strings.NewReader(testICS))
+	assert.Nil(t, err)
+	assert.Len(t, cal.Days, 4)
+
+	date := func(s string) time.Time {
+		d, _ := time.Parse(time.DateOnly, s)
+		return d
+	}
+	// Sunday made a workday.
+	assert.True(t, cal.Matches(scheduleWorkday, date("2024-09-29")))
+	// Tuesday public holiday.
+	assert.True(t, cal.Matches(scheduleHoliday, date("2024-10-01")))
+	// DTEND is exclusive.
+	assert.True(t, cal.Matches(scheduleWorkday, date("2024-10-04")))
+	// Plain weekend.
+	assert.True(t, cal.Matches(scheduleHoliday, date("2024-10-05")))
+
+	var none *Calendar
+	assert.True(t, none.Matches(scheduleWorkday, date("2024-10-01")))
+}
+
+func TestCalendars_RefreshFailure(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	defer db.Close()
+	path := filepath.Join(t.TempDir(), "cn.ics")
+	assert.Nil(t, os.WriteFile(path, []byte(testICS), 0o600))
+	calendars, err := newCalendars(db, "cn="+path+",us=/missing/us.ics", "cn")
+	assert.Nil(t, err)
+
+	// A missing file does not stop the others from loading.
+	mock.ExpectQuery("SELECT calendar, day, workday FROM scene_calendar_day").
+		WillReturnRows(sqlmock.NewRows([]string{"calendar", "day", "workday"}).AddRow("cn", "2024-10-05", true))
+	mock.ExpectQuery("SELECT home_id, calendar FROM scene_home_calendar").
+		WillReturnRows(sqlmock.NewRows([]string{"home_id", "calendar"}))
+	assert.NotNil(t, calendars.Refresh())
+	cal := calendars.Get(1)
+	assert.NotNil(t, cal)
+	assert.Len(t, cal.Days, 5)
+
+	// A removed file keeps its last version, a failing database keeps the
+	// calendars last loaded.
+	defer func(refresh time.Duration) { calendarRefresh = refresh }(calendarRefresh)
+	calendarRefresh = 0
+	assert.Nil(t, os.Remove(path))
+	mock.ExpectQuery("SELECT calendar, day, workday FROM scene_calendar_day").WillReturnError(errors.New("gone"))
+	assert.NotNil(t, calendars.Refresh())
+	assert.Same(t, cal, calendars.Get(1))
+
+	mock.ExpectQuery("SELECT calendar, day, workday FROM scene_calendar_day").
+		WillReturnRows(sqlmock.NewRows([]string{"calendar", "day", "workday"}))
+	mock.ExpectQuery("SELECT home_id, calendar FROM scene_home_calendar").
+		WillReturnRows(sqlmock.NewRows([]string{"home_id", "calendar"}))
+	assert.NotNil(t, calendars.Refresh())
+	cal = calendars.Get(1)
+	assert.Len(t, cal.Days, 4)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -1,6 +1,10 @@
 package scenetiming
 
 import (
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/project-flogo/core/data/coerce"
 )
 
@@ -17,15 +21,87 @@ var shortDayNames = []string{
 type Settings struct {
 	RedisUrl string `md:"redisUrl,required"`
 	MySQLUrl string `md:"mysqlUrl,required"`
+	// CalendarFiles is a comma-separated list of name=path iCalendar files.
+	CalendarFiles   string `md:"calendarFiles"`
+	DefaultCalendar string `md:"defaultCalendar"`
+	Timezone        string `md:"timezone"`
+}
+
+const (
+	modeEvaluate  = "evaluate"
+	modeCountdown = "countdown"
+	modePreview   = "preview"
+)
+
+// maxPreviewCount bounds the run times returned by a preview.
+const maxPreviewCount = 100
+
+type Input struct {
+	Mode     string `md:"mode"`
+	TickTime int64  `md:"tickTime"`
+	SceneID  int64  `md:"sceneID"`
+	Delay    int64  `md:"delay"`
+	Count    int64  `md:"count"`
+}
+
+// Tick returns the scheduled tick time in UTC, falling back to the current time.
+func (i *Input) Tick() time.Time {
+	if i.TickTime <= 0 {
+		return time.Now().UTC()
+	}
+	return time.Unix(i.TickTime, 0).UTC()
+}
+
+// FromMap converts the values from a map into the struct Input
+func (i *Input) FromMap(values map[string]interface{}) (err error) {
+	i.Mode, err = coerce.ToString(values["mode"])
+	if err != nil {
+		return
+	}
+	i.TickTime, err = coerce.ToInt64(values["tickTime"])
+	if err != nil {
+		return
+	}
+	i.SceneID, err = coerce.ToInt64(values["sceneID"])
+	if err != nil {
+		return
+	}
+	i.Delay, err = coerce.ToInt64(values["delay"])
+	if err != nil {
+		return
+	}
+	i.Count, err = coerce.ToInt64(values["count"])
+	return
+}
+
+// ToMap converts the struct Input into a map
+func (i *Input) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"mode":     i.Mode,
+		"tickTime": i.TickTime,
+		"sceneID":  i.SceneID,
+		"delay":    i.Delay,
+		"count":    i.Count,
+	}
 }
 
 type Output struct {
 	SceneIDs []interface{} `md:"sceneIDs"`
+	DueTime  int64         `md:"dueTime"`
+	NextRuns []interface{} `md:"nextRuns"`
 }
 
 // FromMap converts the values from a map into the struct Output
 func (o *Output) FromMap(values map[string]interface{}) (err error) {
 	o.SceneIDs, err = coerce.ToArray(values["sceneIDs"])
+	if err != nil {
+		return
+	}
+	o.DueTime, err = coerce.ToInt64(values["dueTime"])
+	if err != nil {
+		return
+	}
+	o.NextRuns, err = coerce.ToArray(values["nextRuns"])
 	return
 }
 
@@ -33,5 +109,15 @@ func (o *Output) FromMap(values map[string]interface{}) (err error) {
 func (o *Output) ToMap() map[string]interface{} {
 	return map[string]interface{}{
 		"sceneIDs": o.SceneIDs,
+		"dueTime":  o.DueTime,
+		"nextRuns": o.NextRuns,
+	}
+}
+
+func intSliceToString(in []int64) string {
+	var out []string
+	for _, v := range in {
+		out = append(out, fmt.Sprint(v))
 	}
+	return strings.Join(out, ",")
 }
@@ -0,0 +1,188 @@
+package scenetiming
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"strings"
+	"time"
+)
+
+const (
+	minutesPerDay = 24 * 60
+	// nextHorizon bounds the search of Next for schedules that never fire again.
+	nextHorizon = 400
+)
+
+const (
+	scheduleWeekly   = "weekly"
+	scheduleWorkday  = "workday"
+	scheduleHoliday  = "holiday"
+	scheduleInterval = "interval"
+)
+
+// Schedule is a timing condition of a scene. It fires on the days selected by
+// its type, weekday flags or date and, on those days, at a fixed minute, at a
+// randomized minute within a window, or repeatedly every Interval minutes.
+type Schedule struct {
+	TimingID      int64
+	SceneID       int64
+	HomeID        int64
+	ScheduleType  sql.NullString
+	ExecuteHour   sql.NullInt64
+	ExecuteMinute sql.NullInt64
+	ExecuteDate   sql.NullString
+	Weekdays      [7][]byte
+	WindowStart   sql.NullString
+	WindowEnd     sql.NullString
+	Interval      sql.NullInt64
+
+	// Calendar resolves workday and holiday schedules, nil means Monday to Friday.
+	Calendar *Calendar
+	// Location is the timezone of calendar dates.
+	Location *time.Location
+	// Picker pins the randomized minute of a window, nil keeps the deterministic pick.
+	Picker func(key string, minute int) int
+}
+
+// Matches reports whether the schedule fires in the minute of t. An error
+// means the timing row is invalid on the day of t.
+func (s *Schedule) Matches(t time.Time) (bool, error) {
+	t = t.UTC().Truncate(time.Minute)
+	if !s.matchesDay(t) {
+		return false, nil
+	}
+	minutes, err := s.minutes(t.Format(time.DateOnly))
+	if err != nil {
+		return false, fmt.Errorf("timing %d: %v", s.TimingID, err)
+	}
+	minute := t.Hour()*60 + t.Minute()
+	for _, m := range minutes {
+		if m == minute {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// Next returns the first time strictly after the given time at which the
+// schedule fires, or the zero time when it does not fire again.
+func (s *Schedule) Next(after time.Time) time.Time {
+	after = after.UTC()
+	day := time.Date(after.Year(), after.Month(), after.Day(), 0, 0, 0, 0, time.UTC)
+	for i := 0; i < nextHorizon; i++ {
+		minutes, err := s.minutes(day.Format(time.DateOnly))
+		if err != nil {
+			return time.Time{}
+		}
+		for _, m := range minutes {
+			// Calendar days are local, so each candidate time is checked on its own.
+			if t := day.Add(time.Duration(m) * time.Minute); t.After(after) && s.matchesDay(t) {
+				return t
+			}
+		}
+		day = day.AddDate(0, 0, 1)
+	}
+	return time.Time{}
+}
+
+func (s *Schedule) matchesDay(t time.Time) bool {
+	switch s.ScheduleType.String {
+	case scheduleWorkday, scheduleHoliday:
+		location := s.Location
+		if location == nil {
+			location = time.UTC
+		}
+		return s.Calendar.Matches(s.ScheduleType.String, t.In(location))
+	}
+	date := s.ExecuteDate.String
+	if len(date) >= len(time.DateOnly) && date[:len(time.DateOnly)] == t.Format(time.DateOnly) {
+		return true
+	}
+	return isTrue(s.Weekdays[t.Weekday()])
+}
+
+// minutes returns the minutes of the day at which the schedule fires on date, in order.
+func (s *Schedule) minutes(date string) ([]int, error) {
+	if s.ScheduleType.String == scheduleInterval {
+		return s.intervalMinutes()
+	}
+	if s.WindowStart.Valid && s.WindowEnd.Valid {
+		minute, err := s.windowMinute(date)
+		if err != nil {
+			return nil, err
+		}
+		return []int{minute}, nil
+	}
+	if !s.ExecuteHour.Valid || !s.ExecuteMinute.Valid {
+		return nil, errors.New("no execute time")
+	}
+	return []int{int(s.ExecuteHour.Int64*60 + s.ExecuteMinute.Int64)}, nil
+}
+
+func (s *Schedule) intervalMinutes() ([]int, error) {
+	if s.Interval.Int64 <= 0 {
+		return nil, fmt.Errorf("invalid interval %d minutes", s.Interval.Int64)
+	}
+	start, end := 0, minutesPerDay-1
+	var err error
+	if s.WindowStart.Valid {
+		if start, err = parseClock(s.WindowStart.String); err != nil {
+			return nil, err
+		}
+	}
+	if s.WindowEnd.Valid {
+		if end, err = parseClock(s.WindowEnd.String); err != nil {
+			return nil, err
+		}
+	}
+	var minutes []int
+	for m := start; m <= end; m += int(s.Interval.Int64) {
+		minutes = append(minutes, m)
+	}
+	return minutes, nil
+}
+
+// windowMinute picks the minute of the day at which a window fires on date.
+// The pick is derived from the timing ID and date, so every instance computes
+// the same value, and may be pinned through Picker.
+func (s *Schedule) windowMinute(date string) (int, error) {
+	start, err := parseClock(s.WindowStart.String)
+	if err != nil {
+		return 0, err
+	}
+	end, err := parseClock(s.WindowEnd.String)
+	if err != nil {
+		return 0, err
+	}
+	if end < start {
+		return 0, fmt.Errorf("window end %s is before start %s", s.WindowEnd.String, s.WindowStart.String)
+	}
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(s.JitterKey(date)))
+	minute := start + int(h.Sum64()%uint64(end-start+1))
+	if s.Picker != nil {
+		minute = s.Picker(s.JitterKey(date), minute)
+	}
+	return minute, nil
+}
+
+// JitterKey is the cache key holding the window minute picked for the given date.
+func (s *Schedule) JitterKey(date string) string {
+	return fmt.Sprintf("%d:%s", s.TimingID, date)
+}
+
+func parseClock(value string) (int, error) {
+	value = strings.TrimSpace(value)
+	for _, layout := range []string{time.TimeOnly, "15:04"} {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t.Hour()*60 + t.Minute(), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid clock time %q", value)
+}
+
+func isTrue(b []byte) bool {
+	return len(b) > 0 && (b[0] == 1 || b[0] == '1')
+}
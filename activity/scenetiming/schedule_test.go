@@ -0,0 +1,116 @@
+package scenetiming
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// matches calls Matches on a schedule expected to be valid.
+func matches(t *testing.T, s *Schedule, tt time.Time) bool {
+	ok, err := s.Matches(tt)
+	assert.Nil(t, err)
+	return ok
+}
+
+func TestSchedule_Fixed(t *testing.T) {
+	s := &Schedule{
+		ExecuteHour:   sql.NullInt64{Int64: 7, Valid: true},
+		ExecuteMinute: sql.NullInt64{Int64: 30, Valid: true},
+	}
+	// Weekdays only.
+	for day := time.Monday; day <= time.Friday; day++ {
+		s.Weekdays[day] = []byte{1}
+	}
+
+	friday := time.Date(2024, 3, 1, 7, 30, 15, 0, time.UTC)
+	assert.True(t, matches(t, s, friday))
+	assert.False(t, matches(t, s, friday.Add(time.Minute)))
+	assert.False(t, matches(t, s, friday.AddDate(0, 0, 1)))
+
+	// Skips the weekend.
+	assert.Equal(t, time.Date(2024, 3, 4, 7, 30, 0, 0, time.UTC), s.Next(friday))
+
+	// A one-off date without weekday flags.
+	once := &Schedule{
+		ExecuteHour:   sql.NullInt64{Int64: 7, Valid: true},
+		ExecuteMinute: sql.NullInt64{Int64: 30, Valid: true},
+		ExecuteDate:   sql.NullString{String: "2024-03-02T00:00:00+08:00", Valid: true},
+	}
+	assert.True(t, matches(t, once, friday.AddDate(0, 0, 1)))
+	assert.True(t, once.Next(friday.AddDate(0, 0, 1)).IsZero())
+
+	// A missing execute time is an error on the days the schedule applies.
+	broken := &Schedule{TimingID: 7}
+	broken.Weekdays[time.Friday] = []byte{1}
+	ok, err := broken.Matches(friday)
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+}
+
+func TestSchedule_Window(t *testing.T) {
+	s := &Schedule{
+		TimingID:    42,
+		WindowStart: sql.NullString{String: "19:00:00", Valid: true},
+		WindowEnd:   sql.NullString{String: "19:45", Valid: true},
+	}
+	s.Weekdays[time.Friday] = []byte{1}
+
+	next := s.Next(time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	assert.Equal(t, 19, next.Hour())
+	assert.True(t, next.Minute() <= 45)
+	assert.True(t, matches(t, s, next))
+	assert.Equal(t, next.AddDate(0, 0, 7).Weekday(), s.Next(next).Weekday())
+
+	// A pinned minute wins over the deterministic pick.
+	s.Picker = func(key string, minute int) int { return 19*60 + 5 }
+	assert.True(t, matches(t, s, time.Date(2024, 3, 1, 19, 5, 0, 0, time.UTC)))
+
+	// A window ending before it starts is reported, not silently skipped.
+	s.WindowEnd.String = "18:00"
+	ok, err := s.Matches(next)
+	assert.False(t, ok)
+	assert.NotNil(t, err)
+}
+
+func TestSchedule_Interval(t *testing.T) {
+	s := &Schedule{
+		ScheduleType: sql.NullString{String: scheduleInterval, Valid: true},
+		Interval:     sql.NullInt64{Int64: 15, Valid: true},
+		WindowStart:  sql.NullString{String: "08:00:00", Valid: true},
+		WindowEnd:    sql.NullString{String: "20:00:00", Valid: true},
+	}
+	s.Weekdays[time.Friday] = []byte{1}
+
+	for clock, want := range map[string]bool{
+		"07:45": false,
+		"08:00": true,
+		"08:10": false,
+		"08:15": true,
+		"20:00": true,
+		"20:15": false,
+	} {
+		tt, _ := time.Parse(time.DateOnly+" 15:04", "2024-03-01 "+clock)
+		assert.Equal(t, want, matches(t, s, tt), clock)
+	}
+
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 15, 0, 0, time.UTC), s.Next(time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2024, 3, 8, 8, 0, 0, 0, time.UTC), s.Next(time.Date(2024, 3, 1, 20, 0, 0, 0, time.UTC)))
+}
+
+func TestSchedule_Calendar(t *testing.T) {
+	s := &Schedule{
+		ScheduleType:  sql.NullString{String: scheduleWorkday, Valid: true},
+		ExecuteHour:   sql.NullInt64{Int64: 23, Valid: true},
+		ExecuteMinute: sql.NullInt64{Int64: 0, Valid: true},
+		Calendar:      &Calendar{Days: map[string]bool{"2024-03-04": false}},
+		Location:      time.FixedZone("CST", 8*3600),
+	}
+
+	// Sunday 23:00 UTC is Monday 07:00 local, a holiday in the calendar.
+	assert.False(t, matches(t, s, time.Date(2024, 3, 3, 23, 0, 0, 0, time.UTC)))
+	assert.True(t, matches(t, s, time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC)))
+	assert.Equal(t, time.Date(2024, 3, 4, 23, 0, 0, 0, time.UTC), s.Next(time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)))
+}
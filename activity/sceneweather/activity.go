@@ -2,8 +2,15 @@ package sceneweather
 
 import (
 	"context"
+	"crypto/rand"
 	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
+	mrand "math/rand"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	_ "github.com/go-sql-driver/mysql"
@@ -38,14 +45,95 @@ func New(ctx activity.InitContext) (activity.Activity, error) {
 		return nil, err
 	}
 
-	return &Activity{db: db, sceneLock: sceneLock, logger: ctx.Logger()}, nil
+	provider, err := newWeatherProvider(s)
+	if err != nil {
+		return nil, err
+	}
+	cacheTTL := provider.UpdateInterval()
+	if s.WeatherCacheTTL != "" {
+		if cacheTTL, err = time.ParseDuration(s.WeatherCacheTTL); err != nil {
+			return nil, err
+		}
+	}
+	if s.WeatherBatchSize <= 0 {
+		s.WeatherBatchSize = defaultBatchSize
+	}
+	if s.WeatherParallelism <= 0 {
+		s.WeatherParallelism = defaultParallelism
+	}
+	if s.ShardCount <= 0 {
+		s.ShardCount = 1
+	}
+	if s.ShardsPerEval < 0 || s.ShardsPerEval > s.ShardCount {
+		return nil, fmt.Errorf("shards per eval %d is out of range 0-%d", s.ShardsPerEval, s.ShardCount)
+	}
+	evalInterval := defaultEvalInterval
+	if s.EvalInterval != "" {
+		if evalInterval, err = time.ParseDuration(s.EvalInterval); err != nil {
+			return nil, err
+		}
+		if evalInterval < time.Second {
+			return nil, fmt.Errorf("eval interval %s is less than one second", s.EvalInterval)
+		}
+	}
+	if s.GridPrecision < 0 || s.GridPrecision > 12 {
+		return nil, fmt.Errorf("grid precision %d is out of range 0-12", s.GridPrecision)
+	}
+	var timezone *time.Location
+	if s.Timezone != "" {
+		if timezone, err = time.LoadLocation(s.Timezone); err != nil {
+			return nil, err
+		}
+	}
+	weatherCache, err := newCache("scene_weather_data", s.RedisUrl, cacheTTL)
+	if err != nil {
+		return nil, err
+	}
+	var forecastCache *Cache
+	if forecaster, ok := provider.(ForecastProvider); ok {
+		forecastTTL := forecaster.ForecastInterval()
+		if s.ForecastCacheTTL != "" {
+			if forecastTTL, err = time.ParseDuration(s.ForecastCacheTTL); err != nil {
+				return nil, err
+			}
+		}
+		if forecastCache, err = newCache("scene_weather_forecast", s.RedisUrl, forecastTTL); err != nil {
+			return nil, err
+		}
+	}
+
+	return &Activity{
+		db:            db,
+		sceneLock:     sceneLock,
+		provider:      provider,
+		weatherCache:  weatherCache,
+		forecastCache: forecastCache,
+		gridPrecision: s.GridPrecision,
+		batchSize:     s.WeatherBatchSize,
+		parallelism:   s.WeatherParallelism,
+		timezone:      timezone,
+		shardCount:    s.ShardCount,
+		shardsPerEval: s.ShardsPerEval,
+		evalInterval:  evalInterval,
+		logger:        ctx.Logger(),
+	}, nil
 }
 
 // Activity is a Counter Activity implementation
 type Activity struct {
-	db        *sql.DB
-	sceneLock *Lock
-	logger    log.Logger
+	db            *sql.DB
+	sceneLock     *Lock
+	provider      WeatherProvider
+	weatherCache  *Cache
+	forecastCache *Cache
+	gridPrecision int
+	batchSize     int
+	parallelism   int
+	timezone      *time.Location
+	shardCount    int
+	shardsPerEval int
+	evalInterval  time.Duration
+	logger        log.Logger
 }
 
 // Metadata implements activity.Activity.Metadata
@@ -55,14 +143,31 @@ func (a *Activity) Metadata() *activity.Metadata {
 
 // Eval implements activity.Activity.Eval
 func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
-	if ok := a.sceneLock.Lock(); !ok {
-		return false, nil
+	// Start at a random shard so that instances spread over the shards.
+	start := mrand.Intn(a.shardCount)
+	var sceneIDs []interface{}
+	var errs []error
+	evaluated := 0
+	for i := 0; i < a.shardCount; i++ {
+		if a.shardsPerEval > 0 && evaluated >= a.shardsPerEval {
+			break
+		}
+		shard := (start + i) % a.shardCount
+		ids, ok, err := a.evaluateShard(shard)
+		if err != nil {
+			a.logger.Errorf("failed to evaluate weather shard %d : %v", shard, err)
+			errs = append(errs, fmt.Errorf("shard %d: %v", shard, err))
+			continue
+		}
+		if ok {
+			evaluated++
+			sceneIDs = append(sceneIDs, ids...)
+		}
 	}
-	defer a.sceneLock.Unlock()
-
-	sceneIDs, err := a.filterScenes()
-	if err != nil {
-		return false, err
+	if evaluated == 0 {
+		// Every shard locked by other instances is not an error, every
+		// shard failing here is.
+		return false, errors.Join(errs...)
 	}
 
 	output := &Output{SceneIDs: sceneIDs}
@@ -74,10 +179,43 @@ func (a *Activity) Eval(ctx activity.Context) (done bool, err error) {
 	return true, nil
 }
 
-func (a *Activity) filterScenes() ([]interface{}, error) {
-	rows, err := a.db.Query("SELECT a.id, a.scene_id, a.longitude, a.latitude, a.last_compare, a.left, a.opt, a.right FROM scene_condition_weather a " +
-		"INNER JOIN scene_smart_auto_scene b on b.id = a.scene_id and b.deleted = false and b.open = true " +
-		"WHERE a.deleted = false",
+// evaluateShard evaluates the shard if no other instance holds its lock
+// and it was not evaluated yet in the current tick period. Every instance
+// gets the ticks of a period, the first to take the shard evaluates it.
+func (a *Activity) evaluateShard(shard int) ([]interface{}, bool, error) {
+	period := time.Now().Truncate(a.evalInterval)
+	lock := a.sceneLock.Shard(shard)
+	token, ok := lock.Lock()
+	if !ok {
+		return nil, false, nil
+	}
+	held, stop := lock.Watch(token, a.logger)
+	defer func() {
+		stop()
+		lock.Unlock(token)
+	}()
+	if lock.Evaluated(period) {
+		return nil, false, nil
+	}
+
+	sceneIDs, err := a.filterScenes(shard, held)
+	if err != nil {
+		return nil, false, err
+	}
+	if err = lock.MarkEvaluated(period, a.evalInterval); err != nil {
+		a.logger.Errorf("failed to mark weather shard %d evaluated : %v", shard, err)
+	}
+	return sceneIDs, true, nil
+}
+
+// filterScenes evaluates the weather conditions of the shard, those whose
+// id modulo shardCount is shard, and returns the scenes whose condition
+// state changed. held reports whether the run still owns the shard lock;
+// the state changes are only committed while it does.
+func (a *Activity) filterScenes(shard int, held func() bool) ([]interface{}, error) {
+	rows, err := a.db.Query("SELECT a.id, a.scene_id, a.longitude, a.latitude, a.last_compare, a.left, a.opt, a.right, a.reset_right, a.dwell_seconds, a.flip_since, a.lookahead_minutes FROM scene_condition_weather a "+
+		"INNER JOIN scene_smart_auto_scene b on b.id = a.scene_id and b.deleted = false and b.open = true "+
+		"WHERE a.deleted = false AND a.id % ? = ?", a.shardCount, shard,
 	)
 	if err != nil {
 		return nil, err
@@ -85,66 +223,226 @@ func (a *Activity) filterScenes() ([]interface{}, error) {
 	defer rows.Close()
 
 	var operations []Operation
-	var locations Locations
+	var locations, forecastLocations Locations
 	locationFlag := make(map[string]struct{})
+	forecastFlag := make(map[string]struct{})
 	for rows.Next() {
 		var operation Operation
-		if err = rows.Scan(&operation.WeatherID, &operation.SceneID, &operation.Longitude, &operation.Latitude, &operation.LastCompare, &operation.Left, &operation.Opt, &operation.Right); err != nil {
+		if err = rows.Scan(&operation.WeatherID, &operation.SceneID, &operation.Longitude, &operation.Latitude, &operation.LastCompare, &operation.Left, &operation.Opt, &operation.Right,
+			&operation.ResetRight, &operation.DwellSeconds, &operation.FlipSince, &operation.Lookahead); err != nil {
 			return nil, err
 		}
+		if err = operation.Validate(); err == nil && operation.IsForecast() && a.forecastCache == nil {
+			err = fmt.Errorf("weather provider does not support forecasts")
+		}
+		if err != nil {
+			a.logger.Errorf("skip weather condition %d of scene %d: %v", operation.WeatherID, operation.SceneID, err)
+			continue
+		}
+		operation.Timezone = a.timezone
+		if a.gridPrecision > 0 {
+			operation.Cell = EncodeGeohash(operation.Latitude, operation.Longitude, a.gridPrecision)
+		}
 		operations = append(operations, operation)
 		// Merge location information.
 		if _, ok := locationFlag[operation.Key()]; !ok {
 			locationFlag[operation.Key()] = struct{}{}
-			locations = append(locations, operation)
+			locations = append(locations, operation.Location())
+		}
+		if _, ok := forecastFlag[operation.Key()]; !ok && operation.IsForecast() {
+			forecastFlag[operation.Key()] = struct{}{}
+			forecastLocations = append(forecastLocations, operation.Location())
+		}
+	}
+
+	weatherData := a.getWeather(locations)
+	forecastData := a.getForecast(forecastLocations)
+
+	now := time.Now()
+	var changes []stateChange
+	for _, operation := range operations {
+		// Keep the last state of locations whose weather could not be fetched.
+		weather, ok := weatherData[operation.Key()]
+		if !ok {
+			continue
+		}
+		if operation.IsForecast() {
+			if weather.Forecast, ok = forecastData[operation.Key()]; !ok {
+				continue
+			}
+		}
+		flipSince := operation.FlipSince
+		flag := operation.Execute(weather, now)
+		// Track changes of state and changes waiting for their dwell time.
+		if flag != operation.LastState() || flipSince.Valid != operation.FlipSince.Valid {
+			changes = append(changes, stateChange{operation: operation, state: flag, flipSince: flipSince})
 		}
 	}
 
-	weatherData, err := locations.GetData()
+	sceneIDs, err := a.commitChanges(changes, held)
 	if err != nil {
 		return nil, err
 	}
+	a.logger.Infof("the number of weather scenes obtained from shard %d is %d", shard, len(sceneIDs))
+
+	return sceneIDs, nil
+}
+
+// stateChange is a condition whose stored state differs from its evaluation.
+type stateChange struct {
+	operation Operation
+	state     bool
+	flipSince sql.NullInt64 // flip_since before the evaluation
+}
+
+// commitChanges stores the state changes in one transaction. Every update
+// compares against the values the evaluation started from, so a row changed
+// by someone else in the meantime is left alone, and only the scenes whose
+// change was committed are returned.
+func (a *Activity) commitChanges(changes []stateChange, held func() bool) ([]interface{}, error) {
+	if len(changes) == 0 {
+		return nil, nil
+	}
+	tx, err := a.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
 
 	var sceneIDs []interface{}
-	var compareTrueIDs, compareFalseIDs []int64
-	for _, operation := range operations {
-		flag := false
-		if weather, ok := weatherData[operation.Key()]; ok {
-			flag = operation.Execute(weather)
+	for _, change := range changes {
+		operation := change.operation
+		flipped := change.state != operation.LastState()
+		var result sql.Result
+		switch {
+		case flipped:
+			result, err = tx.Exec("UPDATE scene_condition_weather SET last_compare = ?, flip_since = null "+
+				"WHERE id = ? AND IFNULL(last_compare, false) = ?", change.state, operation.WeatherID, operation.LastState())
+		case operation.FlipSince.Valid:
+			result, err = tx.Exec("UPDATE scene_condition_weather SET flip_since = ? "+
+				"WHERE id = ? AND flip_since IS NULL", operation.FlipSince.Int64, operation.WeatherID)
+		default:
+			result, err = tx.Exec("UPDATE scene_condition_weather SET flip_since = null "+
+				"WHERE id = ? AND flip_since = ?", operation.WeatherID, change.flipSince.Int64)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to update weather condition %d : %v", operation.WeatherID, err)
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			a.logger.Warnf("weather condition %d was changed concurrently, skip it", operation.WeatherID)
+			continue
 		}
-		if flag != (len(operation.LastCompare) > 0 && operation.LastCompare[0] == 1) {
+		// Sun events fire once a day, when they become true.
+		if flipped && (change.state || !operation.IsSunEvent()) {
 			sceneIDs = append(sceneIDs, operation.SceneID)
-			if flag {
-				compareTrueIDs = append(compareTrueIDs, operation.WeatherID)
-			} else {
-				compareFalseIDs = append(compareFalseIDs, operation.WeatherID)
-			}
 		}
 	}
 
-	// Update last compare state.
-	if len(compareTrueIDs) > 0 {
-		_, err = a.db.Exec(fmt.Sprintf("UPDATE scene_condition_weather SET last_compare = true "+
-			"WHERE id in (%s)", intSliceToString(compareTrueIDs)))
+	if !held() {
+		return nil, fmt.Errorf("lost the shard lock before committing weather conditions")
 	}
-	if len(compareFalseIDs) > 0 {
-		_, err = a.db.Exec(fmt.Sprintf("UPDATE scene_condition_weather SET last_compare = false "+
-			"WHERE id in (%s)", intSliceToString(compareFalseIDs)))
+	if err = tx.Commit(); err != nil {
+		return nil, err
 	}
-	a.logger.Infof("the number of weather scenes obtained is %d", len(sceneIDs))
-
 	return sceneIDs, nil
 }
 
+// getWeather returns the cached weather of the locations and fetches only the
+// expired ones. Locations whose weather could not be fetched are left out.
+func (a *Activity) getWeather(locations Locations) map[string]WeatherInfo {
+	data := make(map[string]WeatherInfo)
+	var expired Locations
+	for _, location := range locations {
+		var weather WeatherInfo
+		if err := a.weatherCache.GetObject(location.Key(), &weather); err != nil {
+			expired = append(expired, location)
+			continue
+		}
+		data[location.Key()] = weather
+	}
+	if len(expired) == 0 {
+		return data
+	}
+
+	fetched, errs := fetchWeather(a.provider, expired, a.batchSize, a.parallelism)
+	for _, err := range errs {
+		a.logger.Errorf("%v", err)
+	}
+	for key, weather := range fetched {
+		data[key] = weather
+		if err := a.weatherCache.SetObject(key, weather); err != nil {
+			a.logger.Errorf("failed to cache location %s weather data: %v", key, err)
+		}
+	}
+	a.logger.Infof("fetch weather of %d locations, %d succeeded, %d served from cache", len(expired), len(fetched), len(locations)-len(expired))
+
+	return data
+}
+
+// getForecast returns the cached forecast snapshots of the locations and
+// fetches only the expired ones.
+func (a *Activity) getForecast(locations Locations) map[string][]ForecastInfo {
+	data := make(map[string][]ForecastInfo)
+	var expired Locations
+	for _, location := range locations {
+		var forecast []ForecastInfo
+		if err := a.forecastCache.GetObject(location.Key(), &forecast); err != nil {
+			expired = append(expired, location)
+			continue
+		}
+		data[location.Key()] = forecast
+	}
+	if len(expired) == 0 {
+		return data
+	}
+
+	fetched, errs := fetchForecast(a.provider.(ForecastProvider), expired, a.batchSize, a.parallelism)
+	for _, err := range errs {
+		a.logger.Errorf("%v", err)
+	}
+	for key, forecast := range fetched {
+		data[key] = forecast
+		if err := a.forecastCache.SetObject(key, forecast); err != nil {
+			a.logger.Errorf("failed to cache location %s forecast data: %v", key, err)
+		}
+	}
+	a.logger.Infof("fetch forecast of %d locations, %d succeeded, %d served from cache", len(expired), len(fetched), len(locations)-len(expired))
+
+	return data
+}
+
 var (
 	lockExpiration = 5 * time.Minute
 )
 
+const (
+	defaultBatchSize    = 50
+	defaultParallelism  = 4
+	defaultEvalInterval = time.Minute
+)
+
+// Lock is a redis lock owned through a random token, so that only its
+// holder can renew or release it.
 type Lock struct {
 	name string
 	rdb  *redis.Client
 }
 
+var (
+	renewScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0`)
+	unlockScript = redis.NewScript(`if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0`)
+)
+
 func newLock(name string, url string) (*Lock, error) {
 	opt, err := redis.ParseURL(url)
 	if err != nil {
@@ -159,12 +457,118 @@ func newLock(name string, url string) (*Lock, error) {
 	return &Lock{name: name, rdb: rdb}, nil
 }
 
-func (c *Lock) Lock() bool {
-	cmd := c.rdb.SetNX(context.Background(), c.name, time.Now().String(), lockExpiration)
-	ok, err := cmd.Result()
-	return ok && err == nil
+// Lock acquires the lock and returns the token that owns it.
+func (c *Lock) Lock() (string, bool) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", false
+	}
+	token := hex.EncodeToString(buf)
+	ok, err := c.rdb.SetNX(context.Background(), c.name, token, lockExpiration).Result()
+	return token, ok && err == nil
+}
+
+// Shard returns the lock of one shard, sharing the redis client.
+func (c *Lock) Shard(shard int) *Lock {
+	return &Lock{name: fmt.Sprintf("%s:%d", c.name, shard), rdb: c.rdb}
+}
+
+// Evaluated reports whether the shard was evaluated for the tick period
+// starting at period.
+func (c *Lock) Evaluated(period time.Time) bool {
+	last, err := c.rdb.Get(context.Background(), c.name+":evaluated").Int64()
+	return err == nil && last >= period.Unix()
+}
+
+// MarkEvaluated records that the shard was evaluated for the tick period
+// starting at period, the record outlives the period.
+func (c *Lock) MarkEvaluated(period time.Time, interval time.Duration) error {
+	return c.rdb.SetEx(context.Background(), c.name+":evaluated", period.Unix(), interval).Err()
+}
+
+// Renew extends the lock if token still owns it.
+func (c *Lock) Renew(token string) (bool, error) {
+	n, err := renewScript.Run(context.Background(), c.rdb, []string{c.name}, token, lockExpiration.Milliseconds()).Int()
+	return n == 1, err
+}
+
+// Unlock releases the lock if token still owns it.
+func (c *Lock) Unlock(token string) {
+	unlockScript.Run(context.Background(), c.rdb, []string{c.name}, token)
+}
+
+// Watch renews the lock in the background until stop is called. held
+// renews it once more and reports whether token still owns it.
+func (c *Lock) Watch(token string, logger log.Logger) (held func() bool, stop func()) {
+	var lost atomic.Bool
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(lockExpiration / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				ok, err := c.Renew(token)
+				if err != nil {
+					logger.Errorf("failed to renew lock %s : %v", c.name, err)
+					continue
+				}
+				if !ok {
+					logger.Errorf("lost lock %s", c.name)
+					lost.Store(true)
+					return
+				}
+			}
+		}
+	}()
+	held = func() bool {
+		if lost.Load() {
+			return false
+		}
+		ok, err := c.Renew(token)
+		return ok && err == nil
+	}
+	var once sync.Once
+	stop = func() {
+		once.Do(func() { close(done) })
+	}
+	return held, stop
+}
+
+type Cache struct {
+	name string
+	ttl  time.Duration
+	rdb  *redis.Client
+}
+
+func newCache(name string, url string, ttl time.Duration) (*Cache, error) {
+	opt, err := redis.ParseURL(url)
+	if err != nil {
+		return nil, err
+	}
+	rdb := redis.NewClient(opt)
+	err = rdb.SetEx(context.Background(), name, name, 1*time.Second).Err()
+	if err != nil {
+		return nil, err
+	}
+	rdb.Del(context.Background(), name)
+	return &Cache{name: name, ttl: ttl, rdb: rdb}, nil
+}
+
+func (c *Cache) SetObject(key string, value interface{}) error {
+	buff, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return c.rdb.SetEx(context.Background(), fmt.Sprintf("%s:%s", c.name, key), string(buff), c.ttl).Err()
 }
 
-func (c *Lock) Unlock() {
-	c.rdb.Del(context.Background(), c.name)
+func (c *Cache) GetObject(key string, value interface{}) error {
+	buff, err := c.rdb.Get(context.Background(), fmt.Sprintf("%s:%s", c.name, key)).Bytes()
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(buff, value)
 }
@@ -1,9 +1,14 @@
 package sceneweather
 
 import (
+	"errors"
 	"testing"
+	"time"
 
+	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/alicebob/miniredis/v2"
 	"github.com/project-flogo/core/activity"
+	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/support/test"
 	"github.com/stretchr/testify/assert"
 )
@@ -35,3 +40,136 @@ func TestEval(t *testing.T) {
 	tc.GetOutputObject(output)
 	assert.True(t, len(output.SceneIDs) > 0)
 }
+
+func TestLock(t *testing.T) {
+	mr := miniredis.RunT(t)
+	lock, err := newLock("scene_weather_test", "redis://"+mr.Addr())
+	assert.Nil(t, err)
+	lock = lock.Shard(1)
+	assert.Equal(t, "scene_weather_test:1", lock.name)
+
+	token, ok := lock.Lock()
+	assert.True(t, ok)
+	_, ok = lock.Lock()
+	assert.False(t, ok)
+
+	held, stop := lock.Watch(token, log.RootLogger())
+	assert.True(t, held())
+	ok, err = lock.Renew("other")
+	assert.Nil(t, err)
+	assert.False(t, ok)
+
+	lock.Unlock("other")
+	assert.True(t, held())
+	stop()
+	lock.Unlock(token)
+	assert.False(t, held())
+}
+
+func newTestActivity(t *testing.T) (*Activity, sqlmock.Sqlmock, *miniredis.Miniredis) {
+	db, mock, err := sqlmock.New()
+	assert.Nil(t, err)
+	t.Cleanup(func() { _ = db.Close() })
+	mr := miniredis.RunT(t)
+	sceneLock, err := newLock("scene_weather_lock", "redis://"+mr.Addr())
+	assert.Nil(t, err)
+	return &Activity{db: db, sceneLock: sceneLock, shardCount: 2, evalInterval: time.Hour, logger: log.RootLogger()}, mock, mr
+}
+
+func TestEval_ShardErrors(t *testing.T) {
+	a, mock, mr := newTestActivity(t)
+
+	// Every shard failing is an error.
+	mock.ExpectQuery("SELECT a.id").WillReturnError(errors.New("gone"))
+	mock.ExpectQuery("SELECT a.id").WillReturnError(errors.New("gone"))
+	done, err := a.Eval(test.NewActivityContext(a.Metadata()))
+	assert.False(t, done)
+	assert.NotNil(t, err)
+
+	// Shards locked by other instances are not.
+	mr.Set("scene_weather_lock:0", "other")
+	mr.Set("scene_weather_lock:1", "other")
+	done, err = a.Eval(test.NewActivityContext(a.Metadata()))
+	assert.False(t, done)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestCommitChanges(t *testing.T) {
+	a, mock, _ := newTestActivity(t)
+	held := func() bool { return true }
+	changes := []stateChange{
+		{operation: Operation{WeatherID: 1, SceneID: 10, Left: "temperature"}, state: true},
+		{operation: Operation{WeatherID: 2, SceneID: 20, Left: "temperature"}, state: true},
+	}
+
+	// Both changes are committed.
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 1, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 2, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	sceneIDs, err := a.commitChanges(changes, held)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{int64(10), int64(20)}, sceneIDs)
+
+	// A row changed concurrently loses the compare-and-set and is skipped.
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 1, false).WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 2, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+	sceneIDs, err = a.commitChanges(changes, held)
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{int64(20)}, sceneIDs)
+
+	// A run that lost the shard lock rolls back.
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 1, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 2, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectRollback()
+	sceneIDs, err = a.commitChanges(changes, func() bool { return false })
+	assert.NotNil(t, err)
+	assert.Nil(t, sceneIDs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestFilterScenes_NullColumns(t *testing.T) {
+	a, mock, mr := newTestActivity(t)
+	var err error
+	a.weatherCache, err = newCache("scene_weather_cache", "redis://"+mr.Addr(), time.Minute)
+	assert.Nil(t, err)
+	operation := Operation{Longitude: 116.4, Latitude: 39.9}
+	assert.Nil(t, a.weatherCache.SetObject(operation.Key(), WeatherInfo{Temperature: "30"}))
+
+	// A condition created before dwell times, reset thresholds and
+	// forecasts has NULL in their columns.
+	mock.ExpectQuery("SELECT a.id, a.scene_id").WithArgs(2, 1).
+		WillReturnRows(sqlmock.NewRows([]string{"id", "scene_id", "longitude", "latitude", "last_compare", "left", "opt", "right",
+			"reset_right", "dwell_seconds", "flip_since", "lookahead_minutes"}).
+			AddRow(1, 10, 116.4, 39.9, []byte{0}, "tmp", ">", "25", nil, nil, nil, nil))
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE scene_condition_weather SET last_compare").WithArgs(true, 1, false).WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	sceneIDs, err := a.filterScenes(1, func() bool { return true })
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{int64(10)}, sceneIDs)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestEval_OncePerPeriod(t *testing.T) {
+	a, mock, _ := newTestActivity(t)
+	columns := []string{"id", "scene_id", "longitude", "latitude", "last_compare", "left", "opt", "right",
+		"reset_right", "dwell_seconds", "flip_since", "lookahead_minutes"}
+	mock.ExpectQuery("SELECT a.id").WillReturnRows(sqlmock.NewRows(columns))
+	mock.ExpectQuery("SELECT a.id").WillReturnRows(sqlmock.NewRows(columns))
+	done, err := a.Eval(test.NewActivityContext(a.Metadata()))
+	assert.True(t, done)
+	assert.Nil(t, err)
+
+	// Another tick of the same period, on this or another instance, skips
+	// the shards already evaluated.
+	done, err = a.Eval(test.NewActivityContext(a.Metadata()))
+	assert.False(t, done)
+	assert.Nil(t, err)
+	assert.Nil(t, mock.ExpectationsWereMet())
+}
@@ -0,0 +1,182 @@
+package sceneweather
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/project-flogo/core/data/coerce"
+)
+
+// defaultLookahead is the forecast window of a condition without lookahead_minutes.
+const defaultLookahead = 3 * time.Hour
+
+// ForecastInfo is the forecast of one period starting at Time, in unix seconds.
+type ForecastInfo struct {
+	Time            int64  `json:"time"`
+	Temperature     string `json:"temperature"`
+	TempMin         string `json:"tempMin"`
+	TempMax         string `json:"tempMax"`
+	Rainfall        string `json:"rainfall"`
+	RainProbability string `json:"rainProbability"`
+	CondTxt         string `json:"condTxt"`
+}
+
+// ForecastProvider is implemented by weather providers that also forecast.
+type ForecastProvider interface {
+	GetForecast(locations Locations) (map[string][]ForecastInfo, error)
+	// ForecastInterval is how often the provider refreshes its forecasts.
+	ForecastInterval() time.Duration
+}
+
+// forecastWindow returns the periods starting within lookahead after now,
+// including the period in progress.
+func forecastWindow(entries []ForecastInfo, now time.Time, lookahead time.Duration) []ForecastInfo {
+	var window []ForecastInfo
+	for i, entry := range entries {
+		start := time.Unix(entry.Time, 0)
+		if start.After(now.Add(lookahead)) {
+			continue
+		}
+		// A period in progress ends when the next one starts.
+		if i+1 < len(entries) && !time.Unix(entries[i+1].Time, 0).After(now) {
+			continue
+		}
+		window = append(window, entry)
+	}
+	return window
+}
+
+// aggregateForecast reduces a numeric field of the periods with reduce, and
+// returns an empty string when no period reports it.
+func aggregateForecast(field func(f ForecastInfo) string, reduce func(a, b float64) float64) func([]ForecastInfo) string {
+	return func(entries []ForecastInfo) string {
+		var result float64
+		found := false
+		for _, entry := range entries {
+			raw := field(entry)
+			value, err := coerce.ToFloat64(raw)
+			if raw == "" || err != nil {
+				continue
+			}
+			if !found {
+				result, found = value, true
+				continue
+			}
+			result = reduce(result, value)
+		}
+		if !found {
+			return ""
+		}
+		return fmt.Sprint(result)
+	}
+}
+
+func sum(a, b float64) float64 {
+	return a + b
+}
+
+func joinForecastText(entries []ForecastInfo) string {
+	var out []string
+	for _, entry := range entries {
+		out = append(out, entry.CondTxt)
+	}
+	return strings.Join(out, ";")
+}
+
+func (p *openWeatherProvider) ForecastInterval() time.Duration {
+	return time.Hour
+}
+
+type openWeatherForecastResponse struct {
+	List []struct {
+		Dt   int64 `json:"dt"`
+		Main struct {
+			Temp    float64 `json:"temp"`
+			TempMin float64 `json:"temp_min"`
+			TempMax float64 `json:"temp_max"`
+		} `json:"main"`
+		Weather []struct {
+			Description string `json:"description"`
+		} `json:"weather"`
+		Pop  float64            `json:"pop"`
+		Rain map[string]float64 `json:"rain"`
+	} `json:"list"`
+}
+
+func (p *openWeatherProvider) GetForecast(locations Locations) (map[string][]ForecastInfo, error) {
+	data := make(map[string][]ForecastInfo)
+	for _, opt := range locations {
+		query := url.Values{}
+		query.Set("lat", fmt.Sprint(opt.Latitude))
+		query.Set("lon", fmt.Sprint(opt.Longitude))
+		query.Set("appid", p.apiKey)
+		query.Set("units", "metric")
+		req, err := http.NewRequest("GET", p.forecastUrl+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var respData openWeatherForecastResponse
+		if err = doJSON(p.client, req, &respData); err != nil {
+			return nil, err
+		}
+		var entries []ForecastInfo
+		for _, item := range respData.List {
+			entry := ForecastInfo{
+				Time:            item.Dt,
+				Temperature:     fmt.Sprint(item.Main.Temp),
+				TempMin:         fmt.Sprint(item.Main.TempMin),
+				TempMax:         fmt.Sprint(item.Main.TempMax),
+				Rainfall:        fmt.Sprint(item.Rain["3h"]),
+				RainProbability: fmt.Sprint(math.Round(item.Pop * 100)),
+			}
+			if len(item.Weather) > 0 {
+				entry.CondTxt = item.Weather[0].Description
+			}
+			entries = append(entries, entry)
+		}
+		data[opt.Key()] = entries
+	}
+	return data, nil
+}
+
+func (p *staticProvider) ForecastInterval() time.Duration {
+	return time.Minute
+}
+
+func (p *staticProvider) GetForecast(locations Locations) (map[string][]ForecastInfo, error) {
+	buff, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []StaticWeather
+	if err = json.Unmarshal(buff, &entries); err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string][]ForecastInfo)
+	var fallback []ForecastInfo
+	for _, entry := range entries {
+		if entry.Longitude == 0 && entry.Latitude == 0 {
+			fallback = entry.Forecast
+			continue
+		}
+		byKey[(&Operation{Longitude: entry.Longitude, Latitude: entry.Latitude}).Key()] = entry.Forecast
+	}
+
+	data := make(map[string][]ForecastInfo)
+	for _, opt := range locations {
+		if forecast, ok := byKey[opt.Key()]; ok {
+			data[opt.Key()] = forecast
+		} else if fallback != nil {
+			data[opt.Key()] = fallback
+		}
+	}
+	return data, nil
+}
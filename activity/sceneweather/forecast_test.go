@@ -0,0 +1,59 @@
+package sceneweather
+
+import (
+	"database/sql"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOperation_Forecast(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)
+	hour := func(h int) int64 { return time.Date(2024, 3, 1, h, 0, 0, 0, time.UTC).Unix() }
+	weather := WeatherInfo{Forecast: []ForecastInfo{
+		{Time: hour(6), TempMin: "-3", Rainfall: "5", CondTxt: "snow"},
+		{Time: hour(9), TempMin: "2", Rainfall: "0", CondTxt: "clear sky"},
+		{Time: hour(12), TempMin: "4", Rainfall: "0.6", CondTxt: "light rain"},
+		{Time: hour(15), TempMin: "-1", Rainfall: "2", CondTxt: "moderate rain"},
+	}}
+
+	execute := func(left, opt, right string, lookahead int64) bool {
+		op := Operation{
+			Left:      left,
+			Opt:       opt,
+			Right:     sql.NullString{String: right, Valid: true},
+			Lookahead: sql.NullInt64{Int64: lookahead, Valid: true},
+		}
+		assert.Nil(t, op.Validate())
+		return op.Execute(weather, now)
+	}
+	// The 09:00 period is in progress, the 12:00 one starts within two hours.
+	assert.True(t, execute("fc.rainfall", ">", "0", 120))
+	assert.True(t, execute("fc.condTxt", "contains", "rain", 120))
+	assert.False(t, execute("fc.tmpMin", "<", "0", 120))
+	assert.True(t, execute("fc.tmpMin", "<", "0", 300))
+	assert.False(t, execute("fc.rainfall", ">", "0", 60))
+}
+
+func TestOpenWeatherProvider_GetForecast(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"list":[` +
+			`{"dt":1709287200,"main":{"temp":3,"temp_min":1,"temp_max":4},"weather":[{"description":"light rain"}],"pop":0.62,"rain":{"3h":0.8}},` +
+			`{"dt":1709298000,"main":{"temp":0,"temp_min":-2,"temp_max":1},"weather":[{"description":"snow"}],"pop":0.3}]}`))
+	}))
+	defer server.Close()
+
+	provider, err := newWeatherProvider(&Settings{WeatherProvider: providerOpenWeather, ForecastUrl: server.URL, WeatherApiKey: "secret"})
+	assert.Nil(t, err)
+
+	data, err := provider.(ForecastProvider).GetForecast(testLocations[:1])
+	assert.Nil(t, err)
+	forecast := data[testLocations[0].Key()]
+	assert.Len(t, forecast, 2)
+	assert.Equal(t, "62", forecast[0].RainProbability)
+	assert.Equal(t, "0.8", forecast[0].Rainfall)
+	assert.Equal(t, "-2", forecast[1].TempMin)
+}
@@ -0,0 +1,20 @@
+package sceneweather
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGeohash(t *testing.T) {
+	assert.Equal(t, "u4pruydqqvj", EncodeGeohash(57.64911, 10.40744, 11))
+	assert.Equal(t, "u4pru", EncodeGeohash(57.64911, 10.40744, 5))
+
+	// Homes a few dozen meters apart share a cell.
+	assert.Equal(t, EncodeGeohash(40.65817, 109.84041, 6), EncodeGeohash(40.65850, 109.84080, 6))
+
+	latitude, longitude := DecodeGeohash("u4pruydqqvj")
+	assert.InDelta(t, 57.64911, latitude, 0.0001)
+	assert.InDelta(t, 10.40744, longitude, 0.0001)
+	assert.Equal(t, "u4pru", EncodeGeohash(latitude, longitude, 5))
+}
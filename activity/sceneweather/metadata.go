@@ -10,6 +10,33 @@ import (
 type Settings struct {
 	RedisUrl string `md:"redisUrl,required"`
 	MySQLUrl string `md:"mysqlUrl,required"`
+	// WeatherProvider is one of gizwits (default), openweathermap or static.
+	WeatherProvider string `md:"weatherProvider"`
+	WeatherUrl      string `md:"weatherUrl"`
+	WeatherApiKey   string `md:"weatherApiKey"`
+	WeatherFile     string `md:"weatherFile"`
+	ForecastUrl     string `md:"forecastUrl"`
+	// GridPrecision is the geohash precision locations are bucketed by, 0 disables bucketing.
+	GridPrecision int `md:"gridPrecision"`
+	// WeatherCacheTTL overrides how long fetched weather is cached, e.g. 10m.
+	WeatherCacheTTL string `md:"weatherCacheTTL"`
+	// ForecastCacheTTL overrides how long forecast snapshots are cached, e.g. 1h.
+	ForecastCacheTTL string `md:"forecastCacheTTL"`
+	// WeatherBatchSize and WeatherParallelism bound each provider request.
+	WeatherBatchSize   int `md:"weatherBatchSize"`
+	WeatherParallelism int `md:"weatherParallelism"`
+	// ShardCount partitions the weather conditions by id, each shard has its
+	// own lock so that instances evaluate shards in parallel.
+	ShardCount int `md:"shardCount"`
+	// ShardsPerEval bounds the shards one evaluation takes, 0 takes every free shard.
+	ShardsPerEval int `md:"shardsPerEval"`
+	// EvalInterval is the period of the ticks that trigger the evaluation,
+	// e.g. 1m (default). Each shard is evaluated once per period, by the
+	// first instance to take it.
+	EvalInterval string `md:"evalInterval"`
+	// Timezone of the provider's sunrise and sunset times, approximated from
+	// the longitude when empty.
+	Timezone string `md:"timezone"`
 }
 
 type Output struct {
@@ -1,12 +1,11 @@
 package sceneweather
 
 import (
-	"bytes"
 	"database/sql"
-	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/project-flogo/core/data/coerce"
@@ -21,33 +20,223 @@ type Operation struct {
 	Left        string
 	Opt         string
 	Right       sql.NullString
+	// ResetRight is the threshold the reading must cross back over before a
+	// true condition resets, leaving a dead-band around Right.
+	ResetRight sql.NullString
+	// DwellSeconds is how long a new state must hold before it counts,
+	// NULL counts at once.
+	DwellSeconds sql.NullInt64
+	// FlipSince is when a pending state change was first seen, in unix seconds.
+	FlipSince sql.NullInt64
+	// Lookahead is the forecast window of a forecast operand, in minutes.
+	Lookahead sql.NullInt64
+	// Timezone is the local time of the location, approximated from the
+	// longitude when nil.
+	Timezone *time.Location
+	// Cell is the geohash grid cell of the location, set when bucketing is enabled.
+	Cell string
 }
 
+// Key identifies the location the weather is fetched for.
 func (c *Operation) Key() string {
+	if c.Cell != "" {
+		return c.Cell
+	}
 	return fmt.Sprintf("%f:%f", c.Longitude, c.Latitude)
 }
 
-func (c *Operation) Execute(weather WeatherInfo) bool {
-	rightValue, _ := coerce.ToFloat64(c.Right.String)
-	var leftValue float64
-	switch c.Left {
-	case "sr":
-		leftValue, _ = coerce.ToFloat64(weather.Sunrise)
-		rightValue = float64(time.Now().Unix())
-	case "ss":
-		leftValue, _ = coerce.ToFloat64(weather.Sunset)
-		rightValue = float64(time.Now().Unix())
-	case "pm2.5":
-		leftValue, _ = coerce.ToFloat64(weather.Pm25)
-	case "tmp":
-		leftValue, _ = coerce.ToFloat64(weather.Temperature)
-	case "hum":
-		leftValue, _ = coerce.ToFloat64(weather.Humidity)
+// Location returns the operation placed at the center of its cell, so every
+// home in the cell shares the weather fetched for it.
+func (c Operation) Location() Operation {
+	if c.Cell != "" {
+		c.Latitude, c.Longitude = DecodeGeohash(c.Cell)
+	}
+	return c
+}
+
+// operand reads a condition operand from the weather. Text operands are
+// matched as strings, the others are compared as numbers.
+type operand struct {
+	value func(weather WeatherInfo) string
+	// forecast reads a forecast operand from the periods within the lookahead.
+	forecast func(entries []ForecastInfo) string
+	text     bool
+}
+
+var operands = map[string]operand{
+	"sr":         {value: func(w WeatherInfo) string { return w.Sunrise }},
+	"ss":         {value: func(w WeatherInfo) string { return w.Sunset }},
+	"tmp":        {value: func(w WeatherInfo) string { return w.Temperature }},
+	"hum":        {value: func(w WeatherInfo) string { return w.Humidity }},
+	"pm2.5":      {value: func(w WeatherInfo) string { return w.Pm25 }},
+	"pm10":       {value: func(w WeatherInfo) string { return w.Pm10 }},
+	"aqi":        {value: func(w WeatherInfo) string { return w.Aqi }},
+	"co":         {value: func(w WeatherInfo) string { return w.Co }},
+	"no2":        {value: func(w WeatherInfo) string { return w.No2 }},
+	"o3":         {value: func(w WeatherInfo) string { return w.O3 }},
+	"so2":        {value: func(w WeatherInfo) string { return w.So2 }},
+	"rainfall":   {value: func(w WeatherInfo) string { return w.Rainfall }},
+	"windSpeed":  {value: func(w WeatherInfo) string { return w.WindSpeed }},
+	"windDeg":    {value: func(w WeatherInfo) string { return w.WindDeg }},
+	"pressure":   {value: func(w WeatherInfo) string { return w.Pressure }},
+	"windDirect": {value: func(w WeatherInfo) string { return w.WindDirect }, text: true},
+	"condTxt":    {value: func(w WeatherInfo) string { return w.CondTxt }, text: true},
+	"airQuality": {value: func(w WeatherInfo) string { return w.AirQuality }, text: true},
+
+	"fc.tmpMin":   {forecast: aggregateForecast(func(f ForecastInfo) string { return f.TempMin }, math.Min)},
+	"fc.tmpMax":   {forecast: aggregateForecast(func(f ForecastInfo) string { return f.TempMax }, math.Max)},
+	"fc.rainfall": {forecast: aggregateForecast(func(f ForecastInfo) string { return f.Rainfall }, sum)},
+	"fc.pop":      {forecast: aggregateForecast(func(f ForecastInfo) string { return f.RainProbability }, math.Max)},
+	"fc.condTxt":  {forecast: joinForecastText, text: true},
+}
+
+var (
+	numberOpts = map[string]struct{}{"==": {}, "!=": {}, ">": {}, ">=": {}, "<": {}, "<=": {}}
+	textOpts   = map[string]struct{}{"==": {}, "!=": {}, "contains": {}, "!contains": {}}
+)
+
+// Validate rejects conditions with an unknown operand or an operator that
+// does not apply to it.
+func (c *Operation) Validate() error {
+	left, ok := operands[c.Left]
+	if !ok {
+		return fmt.Errorf("unknown weather operand %q", c.Left)
+	}
+	if left.text {
+		if _, ok = textOpts[c.Opt]; !ok {
+			return fmt.Errorf("operator %q is not supported by text operand %s", c.Opt, c.Left)
+		}
+		return nil
+	}
+	if _, ok = numberOpts[c.Opt]; !ok {
+		return fmt.Errorf("operator %q is not supported by operand %s", c.Opt, c.Left)
+	}
+	if left.forecast != nil && c.Lookahead.Valid && c.Lookahead.Int64 <= 0 {
+		return fmt.Errorf("invalid forecast lookahead %d minutes", c.Lookahead.Int64)
+	}
+	if c.DwellSeconds.Int64 < 0 {
+		return fmt.Errorf("invalid dwell time %d seconds", c.DwellSeconds.Int64)
+	}
+	if c.IsSunEvent() {
+		if _, err := c.sunOffset(); err != nil {
+			return err
+		}
+		return nil
+	}
+	right, err := coerce.ToFloat64(c.Right.String)
+	if err != nil {
+		return fmt.Errorf("operand %s requires a number, got %q", c.Left, c.Right.String)
+	}
+	if !c.ResetRight.Valid {
+		return nil
+	}
+	reset, err := coerce.ToFloat64(c.ResetRight.String)
+	if err != nil {
+		return fmt.Errorf("operand %s requires a numeric reset threshold, got %q", c.Left, c.ResetRight.String)
+	}
+	switch c.Opt {
+	case ">", ">=":
+		if reset > right {
+			return fmt.Errorf("reset threshold %v must not be above %v", reset, right)
+		}
+	case "<", "<=":
+		if reset < right {
+			return fmt.Errorf("reset threshold %v must not be below %v", reset, right)
+		}
 	default:
+		return fmt.Errorf("operator %q does not support a reset threshold", c.Opt)
+	}
+	return nil
+}
+
+// IsForecast reports whether the condition needs the forecast of its location.
+func (c *Operation) IsForecast() bool {
+	return operands[c.Left].forecast != nil
+}
+
+// LastState is the state of the condition at the previous evaluation.
+func (c *Operation) LastState() bool {
+	return len(c.LastCompare) > 0 && c.LastCompare[0] == 1
+}
+
+// Execute returns the state of the condition at now. A true condition with
+// a reset threshold stays true until the reading crosses it, and a change
+// of state only counts once it has held for DwellSeconds, tracked through
+// FlipSince.
+func (c *Operation) Execute(weather WeatherInfo, now time.Time) bool {
+	last := c.LastState()
+	state := c.compare(weather, last, now)
+	if state == last {
+		c.FlipSince = sql.NullInt64{}
+		return last
+	}
+	if c.DwellSeconds.Int64 > 0 {
+		if !c.FlipSince.Valid {
+			c.FlipSince = sql.NullInt64{Int64: now.Unix(), Valid: true}
+			return last
+		}
+		if now.Unix()-c.FlipSince.Int64 < c.DwellSeconds.Int64 {
+			return last
+		}
+	}
+	c.FlipSince = sql.NullInt64{}
+	return state
+}
+
+func (c *Operation) compare(weather WeatherInfo, last bool, now time.Time) bool {
+	if c.IsSunEvent() {
+		return c.afterSunEvent(weather, now)
+	}
+	if last && c.ResetRight.Valid {
+		switch c.Opt {
+		case ">", ">=":
+			return !c.match(weather, "<", c.ResetRight.String, now)
+		case "<", "<=":
+			return !c.match(weather, ">", c.ResetRight.String, now)
+		}
+	}
+	return c.match(weather, c.Opt, c.Right.String, now)
+}
+
+func (c *Operation) match(weather WeatherInfo, opt string, right string, now time.Time) bool {
+	left, ok := operands[c.Left]
+	if !ok {
 		return false
 	}
+	var raw string
+	if left.forecast != nil {
+		lookahead := defaultLookahead
+		if c.Lookahead.Valid {
+			lookahead = time.Duration(c.Lookahead.Int64) * time.Minute
+		}
+		raw = left.forecast(forecastWindow(weather.Forecast, now, lookahead))
+	} else {
+		raw = left.value(weather)
+	}
 
-	switch c.Opt {
+	if left.text {
+		leftValue := strings.ToLower(strings.TrimSpace(raw))
+		rightValue := strings.ToLower(strings.TrimSpace(right))
+		switch opt {
+		case "==":
+			return leftValue == rightValue
+		case "!=":
+			return leftValue != rightValue
+		case "contains":
+			return strings.Contains(leftValue, rightValue)
+		case "!contains":
+			return !strings.Contains(leftValue, rightValue)
+		}
+		return false
+	}
+
+	// Missing or malformed readings never satisfy a numeric condition.
+	leftValue, err := coerce.ToFloat64(raw)
+	if err != nil || raw == "" {
+		return false
+	}
+	rightValue, _ := coerce.ToFloat64(right)
+	switch opt {
 	case "==":
 		return leftValue == rightValue
 	case "!=":
@@ -64,20 +253,88 @@ func (c *Operation) Execute(weather WeatherInfo) bool {
 	return false
 }
 
-var (
-	weatherClient = &http.Client{Timeout: 60 * time.Second}
-	weatherURL    = "http://backend-zg.iotsdk.com/ms/weather/api/batch"
-)
+// sunEventWindow is how long after a sunrise or sunset its condition stays
+// true, so a late evaluation still fires it.
+var sunEventWindow = 30 * time.Minute
 
-type WeatherRequestData struct {
-	Latitude  float64 `json:"latitude"`
-	Longitude float64 `json:"longitude"`
+// IsSunEvent reports whether the condition fires at sunrise or sunset. Only
+// the change to true of such a condition triggers its scene.
+func (c *Operation) IsSunEvent() bool {
+	return c.Left == "sr" || c.Left == "ss"
 }
 
-type WeatherResponse struct {
-	Error   bool          `json:"error"`
-	Message string        `json:"message"`
-	Data    []WeatherInfo `json:"data"`
+// sunOffset is the offset from the sun event in Right, in minutes.
+func (c *Operation) sunOffset() (time.Duration, error) {
+	if strings.TrimSpace(c.Right.String) == "" {
+		return 0, nil
+	}
+	minutes, err := coerce.ToFloat64(strings.TrimSpace(c.Right.String))
+	if err != nil {
+		return 0, fmt.Errorf("sun event offset must be minutes, got %q", c.Right.String)
+	}
+	return time.Duration(minutes * float64(time.Minute)), nil
+}
+
+// afterSunEvent reports whether now is within sunEventWindow after the
+// sunrise or sunset of the local day plus the offset in Right.
+func (c *Operation) afterSunEvent(weather WeatherInfo, now time.Time) bool {
+	offset, err := c.sunOffset()
+	if err != nil {
+		return false
+	}
+	event, ok := c.sunEvent(weather, now)
+	if !ok {
+		return false
+	}
+	event = event.Add(offset)
+	return !now.Before(event) && now.Before(event.Add(sunEventWindow))
+}
+
+// sunEvent returns the sunrise or sunset on the local day of now, parsed
+// from the provider or computed from the coordinates when it is missing.
+func (c *Operation) sunEvent(weather WeatherInfo, now time.Time) (time.Time, bool) {
+	zone := c.Timezone
+	if zone == nil {
+		zone = time.FixedZone("", int(math.Round(c.Longitude/15))*3600)
+	}
+	local := now.In(zone)
+
+	raw := weather.Sunrise
+	if c.Left == "ss" {
+		raw = weather.Sunset
+	}
+	if t, ok := parseLocalTime(raw, local); ok {
+		return t, true
+	}
+
+	sunrise, sunset, ok := SunTimes(c.Latitude, c.Longitude, local)
+	if c.Left == "ss" {
+		return sunset, ok
+	}
+	return sunrise, ok
+}
+
+// parseLocalTime parses a provider time as a clock time on the day of local,
+// a local date time or unix seconds.
+func parseLocalTime(raw string, local time.Time) (time.Time, bool) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return time.Time{}, false
+	}
+	for _, layout := range []string{"15:04", time.TimeOnly} {
+		if t, err := time.Parse(layout, raw); err == nil {
+			return time.Date(local.Year(), local.Month(), local.Day(), t.Hour(), t.Minute(), t.Second(), 0, local.Location()), true
+		}
+	}
+	for _, layout := range []string{time.DateTime, "2006-01-02 15:04"} {
+		if t, err := time.ParseInLocation(layout, raw, local.Location()); err == nil {
+			return t, true
+		}
+	}
+	if unix, err := strconv.ParseInt(raw, 10, 64); err == nil && unix > 0 {
+		return time.Unix(unix, 0), true
+	}
+	return time.Time{}, false
 }
 
 type WeatherInfo struct {
@@ -101,49 +358,11 @@ type WeatherInfo struct {
 	WindDirect  string `json:"windDirect"`
 	WindDeg     string `json:"windDeg"`
 	Pressure    string `json:"pressure"`
+	// Latitude and Longitude echo the requested coordinate when the provider reports it.
+	Latitude  interface{} `json:"latitude,omitempty"`
+	Longitude interface{} `json:"longitude,omitempty"`
+	// Forecast is attached from the forecast cache before evaluation.
+	Forecast []ForecastInfo `json:"-"`
 }
 
 type Locations []Operation
-
-func (l Locations) GetData() (map[string]WeatherInfo, error) {
-	var reqData []WeatherRequestData
-	for _, opt := range l {
-		reqData = append(reqData, WeatherRequestData{Latitude: opt.Latitude, Longitude: opt.Longitude})
-	}
-	val, err := json.Marshal(reqData)
-	if err != nil {
-		return nil, err
-	}
-	req, err := http.NewRequest("POST", weatherURL, bytes.NewReader(val))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-
-	resp, err := weatherClient.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("status code is %d", resp.StatusCode)
-	}
-	defer resp.Body.Close()
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
-	}
-	var respData WeatherResponse
-	if err = json.Unmarshal(body, &respData); err != nil {
-		return nil, err
-	}
-	if respData.Error {
-		return nil, fmt.Errorf("error message is %s", respData.Message)
-	}
-
-	data := make(map[string]WeatherInfo)
-	for idx, opt := range l {
-		data[opt.Key()] = respData.Data[idx]
-	}
-	return data, nil
-}
@@ -1,20 +1,137 @@
 package sceneweather
 
 import (
-	"fmt"
+	"database/sql"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
 
-func TestLocations_GetData(t *testing.T) {
-	var locations Locations = []Operation{
-		{Longitude: 109.84041, Latitude: 40.65817},
-		{Longitude: 129.461205, Latitude: 35.42859},
-		{Longitude: 119.461205, Latitude: 35.42859},
+func TestOperation_Validate(t *testing.T) {
+	for _, c := range []struct {
+		left, opt, right string
+		valid            bool
+	}{
+		{"tmp", ">", "25", true},
+		{"windSpeed", "<=", "3.5", true},
+		{"condTxt", "contains", "rain", true},
+		{"airQuality", "==", "heavy pollution", true},
+		{"visibility", ">", "10", false},
+		{"condTxt", ">", "rain", false},
+		{"tmp", "contains", "2", false},
+		{"tmp", ">", "warm", false},
+		{"sr", ">", "", true},
+	} {
+		op := Operation{Left: c.left, Opt: c.opt, Right: sql.NullString{String: c.right, Valid: true}}
+		assert.Equal(t, c.valid, op.Validate() == nil, "%s %s %s", c.left, c.opt, c.right)
 	}
+}
+
+func TestOperation_Execute(t *testing.T) {
+	weather := WeatherInfo{
+		Temperature: "26.5",
+		Aqi:         "180",
+		WindSpeed:   "",
+		CondTxt:     "Light Rain",
+		AirQuality:  "Heavy pollution",
+	}
+
+	execute := func(left, opt, right string) bool {
+		op := Operation{Left: left, Opt: opt, Right: sql.NullString{String: right, Valid: true}}
+		return op.Execute(weather, time.Now())
+	}
+	assert.True(t, execute("tmp", ">", "26"))
+	assert.True(t, execute("aqi", ">=", "150"))
+	assert.True(t, execute("condTxt", "contains", "rain"))
+	assert.False(t, execute("condTxt", "!contains", "RAIN"))
+	assert.True(t, execute("airQuality", "==", "heavy pollution"))
+	// A missing reading is not zero.
+	assert.False(t, execute("windSpeed", "<", "5"))
+}
+
+func TestOperation_DeadBand(t *testing.T) {
+	op := Operation{
+		Left:       "tmp",
+		Opt:        ">",
+		Right:      sql.NullString{String: "26", Valid: true},
+		ResetRight: sql.NullString{String: "24", Valid: true},
+	}
+	assert.Nil(t, op.Validate())
+
+	now := time.Now()
+	for _, step := range []struct {
+		tmp  string
+		want bool
+	}{
+		{"25", false},
+		{"26.5", true},
+		{"25", true},
+		{"24.5", true},
+		{"23.9", false},
+		{"25.9", false},
+	} {
+		state := op.Execute(WeatherInfo{Temperature: step.tmp}, now)
+		assert.Equal(t, step.want, state, step.tmp)
+		op.LastCompare = []byte{0}
+		if state {
+			op.LastCompare = []byte{1}
+		}
+	}
+
+	op.ResetRight.String = "27"
+	assert.NotNil(t, op.Validate())
+}
+
+func TestOperation_Dwell(t *testing.T) {
+	op := Operation{
+		Left:         "hum",
+		Opt:          ">=",
+		Right:        sql.NullString{String: "80", Valid: true},
+		DwellSeconds: sql.NullInt64{Int64: 600, Valid: true},
+	}
+
+	start := time.Now()
+	humid := WeatherInfo{Humidity: "85"}
+	assert.False(t, op.Execute(humid, start))
+	assert.True(t, op.FlipSince.Valid)
+	assert.False(t, op.Execute(humid, start.Add(5*time.Minute)))
+
+	// A reading back below the threshold cancels the pending change.
+	assert.False(t, op.Execute(WeatherInfo{Humidity: "70"}, start.Add(6*time.Minute)))
+	assert.False(t, op.FlipSince.Valid)
+
+	assert.False(t, op.Execute(humid, start.Add(7*time.Minute)))
+	assert.True(t, op.Execute(humid, start.Add(17*time.Minute)))
+	assert.False(t, op.FlipSince.Valid)
+}
+
+func TestOperation_SunEvent(t *testing.T) {
+	beijing := time.FixedZone("CST", 8*3600)
+	op := Operation{
+		Left:      "sr",
+		Opt:       "==",
+		Right:     sql.NullString{String: "20", Valid: true},
+		Longitude: 116.4074,
+		Latitude:  39.9042,
+		Timezone:  beijing,
+	}
+	assert.Nil(t, op.Validate())
+
+	weather := WeatherInfo{Sunrise: "05:10"}
+	at := func(clock string) time.Time {
+		t, _ := time.ParseInLocation(time.DateTime, "2024-06-21 "+clock, beijing)
+		return t
+	}
+	assert.False(t, op.Execute(weather, at("05:29:00")))
+	assert.True(t, op.Execute(weather, at("05:30:00")))
+	assert.True(t, op.Execute(weather, at("05:45:00")))
+	assert.False(t, op.Execute(weather, at("06:00:00")))
+
+	// Falls back to the computed sunrise, about 04:46 in Beijing.
+	assert.True(t, op.Execute(WeatherInfo{Sunrise: "n/a"}, at("05:10:00")))
+	assert.False(t, op.Execute(WeatherInfo{}, at("04:50:00")))
 
-	data, err := locations.GetData()
-	assert.Nil(t, err)
-	fmt.Println(data)
+	op.Right.String = "later"
+	assert.NotNil(t, op.Validate())
 }
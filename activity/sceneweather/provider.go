@@ -0,0 +1,379 @@
+package sceneweather
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/project-flogo/core/data/coerce"
+)
+
+const (
+	providerGizwits     = "gizwits"
+	providerOpenWeather = "openweathermap"
+	providerStatic      = "static"
+)
+
+var (
+	weatherClient     = &http.Client{Timeout: 60 * time.Second}
+	gizwitsWeatherURL = "http://backend-zg.iotsdk.com/ms/weather/api/batch"
+	openWeatherURL    = "https://api.openweathermap.org/data/2.5/weather"
+	openForecastURL   = "https://api.openweathermap.org/data/2.5/forecast"
+)
+
+// WeatherProvider fetches the current weather of locations, keyed by Operation.Key.
+type WeatherProvider interface {
+	GetData(locations Locations) (map[string]WeatherInfo, error)
+	// UpdateInterval is how often the provider refreshes its observations.
+	UpdateInterval() time.Duration
+}
+
+func newWeatherProvider(s *Settings) (WeatherProvider, error) {
+	switch s.WeatherProvider {
+	case "", providerGizwits:
+		return &gizwitsProvider{url: withDefault(s.WeatherUrl, gizwitsWeatherURL), client: weatherClient, cities: make(map[string]string)}, nil
+	case providerOpenWeather:
+		if s.WeatherApiKey == "" {
+			return nil, fmt.Errorf("weather provider %s requires an API key", s.WeatherProvider)
+		}
+		return &openWeatherProvider{
+			url:         withDefault(s.WeatherUrl, openWeatherURL),
+			forecastUrl: withDefault(s.ForecastUrl, openForecastURL),
+			apiKey:      s.WeatherApiKey,
+			client:      weatherClient,
+		}, nil
+	case providerStatic:
+		if s.WeatherFile == "" {
+			return nil, fmt.Errorf("weather provider %s requires a weather file", s.WeatherProvider)
+		}
+		return &staticProvider{path: s.WeatherFile}, nil
+	}
+	return nil, fmt.Errorf("unsupported weather provider %s", s.WeatherProvider)
+}
+
+// fetchWeather splits locations into chunks of at most batchSize and fetches
+// them with at most parallelism concurrent requests. A failed chunk does not
+// fail the others, its error is returned alongside the weather fetched.
+func fetchWeather(provider WeatherProvider, locations Locations, batchSize, parallelism int) (map[string]WeatherInfo, []error) {
+	return fetchChunks(locations, batchSize, parallelism, provider.GetData)
+}
+
+// fetchForecast fetches forecasts in chunks like fetchWeather.
+func fetchForecast(provider ForecastProvider, locations Locations, batchSize, parallelism int) (map[string][]ForecastInfo, []error) {
+	return fetchChunks(locations, batchSize, parallelism, provider.GetForecast)
+}
+
+func fetchChunks[T any](locations Locations, batchSize, parallelism int, fetch func(Locations) (map[string]T, error)) (map[string]T, []error) {
+	if batchSize <= 0 {
+		batchSize = len(locations)
+	}
+	if parallelism <= 0 {
+		parallelism = 1
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var errs []error
+	data := make(map[string]T)
+	sem := make(chan struct{}, parallelism)
+	for start := 0; start < len(locations); start += batchSize {
+		end := start + batchSize
+		if end > len(locations) {
+			end = len(locations)
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(chunk Locations) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			result, err := fetch(chunk)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Errorf("failed to fetch weather of %d locations from %s: %v", len(chunk), chunk[0].Key(), err))
+			}
+			// A partial result still counts for the locations it covers.
+			for key, value := range result {
+				data[key] = value
+			}
+		}(locations[start:end])
+	}
+	wg.Wait()
+
+	return data, errs
+}
+
+func withDefault(value, defaultValue string) string {
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// gizwitsProvider queries the Gizwits weather batch API.
+type gizwitsProvider struct {
+	url    string
+	client *http.Client
+
+	mu sync.Mutex
+	// cities holds the city ID last reported for each location key, to match
+	// the results that do not echo their coordinate.
+	cities map[string]string
+}
+
+type WeatherRequestData struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+}
+
+type WeatherResponse struct {
+	Error   bool          `json:"error"`
+	Message string        `json:"message"`
+	Data    []WeatherInfo `json:"data"`
+}
+
+func (p *gizwitsProvider) UpdateInterval() time.Duration {
+	return 15 * time.Minute
+}
+
+func (p *gizwitsProvider) GetData(locations Locations) (map[string]WeatherInfo, error) {
+	var reqData []WeatherRequestData
+	for _, opt := range locations {
+		reqData = append(reqData, WeatherRequestData{Latitude: opt.Latitude, Longitude: opt.Longitude})
+	}
+	val, err := json.Marshal(reqData)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(val))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	var respData WeatherResponse
+	if err = doJSON(p.client, req, &respData); err != nil {
+		return nil, err
+	}
+	if respData.Error {
+		return nil, fmt.Errorf("error message is %s", respData.Message)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return matchWeather(locations, respData.Data, p.cities)
+}
+
+// coordinateTolerance is how far an echoed coordinate may be from the requested one.
+const coordinateTolerance = 1e-4
+
+// matchWeather assigns results to locations by the coordinates echoed in each
+// result, and records the city ID of the locations matched so in cities.
+// Results without coordinates are matched by their city ID to the locations
+// last seen in that city, and dropped otherwise. A response that echoes no
+// coordinate at all, as the Gizwits batch API does, is matched by position
+// when it has one result per location. The matched results are returned
+// along with an error counting the dropped ones.
+func matchWeather(locations Locations, results []WeatherInfo, cities map[string]string) (map[string]WeatherInfo, error) {
+	data := make(map[string]WeatherInfo)
+	var unmatched []WeatherInfo
+	for _, info := range results {
+		latitude, latErr := coerce.ToFloat64(info.Latitude)
+		longitude, lonErr := coerce.ToFloat64(info.Longitude)
+		if info.Latitude == nil || info.Longitude == nil || latErr != nil || lonErr != nil {
+			unmatched = append(unmatched, info)
+			continue
+		}
+		for _, opt := range locations {
+			if math.Abs(opt.Latitude-latitude) <= coordinateTolerance && math.Abs(opt.Longitude-longitude) <= coordinateTolerance {
+				data[opt.Key()] = info
+				if info.CityId != "" {
+					cities[opt.Key()] = info.CityId
+				}
+			}
+		}
+	}
+
+	if len(unmatched) == len(results) && len(results) == len(locations) {
+		for idx, opt := range locations {
+			data[opt.Key()] = results[idx]
+		}
+		return data, nil
+	}
+
+	dropped := 0
+	for _, info := range unmatched {
+		matched := false
+		for _, opt := range locations {
+			if _, ok := data[opt.Key()]; !ok && info.CityId != "" && cities[opt.Key()] == info.CityId {
+				data[opt.Key()] = info
+				matched = true
+			}
+		}
+		if !matched {
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		return data, fmt.Errorf("dropped %d of %d weather results without coordinates or a known city", dropped, len(results))
+	}
+	return data, nil
+}
+
+// openWeatherProvider queries an OpenWeatherMap compatible current weather API,
+// one request per location.
+type openWeatherProvider struct {
+	url         string
+	forecastUrl string
+	apiKey      string
+	client      *http.Client
+}
+
+type openWeatherResponse struct {
+	ID      int64  `json:"id"`
+	Name    string `json:"name"`
+	Weather []struct {
+		Main        string `json:"main"`
+		Description string `json:"description"`
+	} `json:"weather"`
+	Main struct {
+		Temp     float64 `json:"temp"`
+		Humidity float64 `json:"humidity"`
+		Pressure float64 `json:"pressure"`
+	} `json:"main"`
+	Wind struct {
+		Speed float64 `json:"speed"`
+		Deg   float64 `json:"deg"`
+	} `json:"wind"`
+	Rain map[string]float64 `json:"rain"`
+	Sys  struct {
+		Sunrise int64 `json:"sunrise"`
+		Sunset  int64 `json:"sunset"`
+	} `json:"sys"`
+}
+
+func (p *openWeatherProvider) UpdateInterval() time.Duration {
+	return 10 * time.Minute
+}
+
+func (p *openWeatherProvider) GetData(locations Locations) (map[string]WeatherInfo, error) {
+	data := make(map[string]WeatherInfo)
+	for _, opt := range locations {
+		query := url.Values{}
+		query.Set("lat", fmt.Sprint(opt.Latitude))
+		query.Set("lon", fmt.Sprint(opt.Longitude))
+		query.Set("appid", p.apiKey)
+		query.Set("units", "metric")
+		req, err := http.NewRequest("GET", p.url+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var respData openWeatherResponse
+		if err = doJSON(p.client, req, &respData); err != nil {
+			return nil, err
+		}
+		data[opt.Key()] = respData.toWeatherInfo()
+	}
+	return data, nil
+}
+
+func (r *openWeatherResponse) toWeatherInfo() WeatherInfo {
+	// Sun times are reported in unix seconds, a clock time would be read in
+	// the configured or guessed timezone rather than the location's own.
+	info := WeatherInfo{
+		Temperature: fmt.Sprint(r.Main.Temp),
+		Humidity:    fmt.Sprint(r.Main.Humidity),
+		Pressure:    fmt.Sprint(r.Main.Pressure),
+		WindSpeed:   fmt.Sprint(r.Wind.Speed),
+		WindDeg:     fmt.Sprint(r.Wind.Deg),
+		Rainfall:    fmt.Sprint(r.Rain["1h"]),
+		CityId:      fmt.Sprint(r.ID),
+		CityName:    r.Name,
+	}
+	if r.Sys.Sunrise > 0 {
+		info.Sunrise = fmt.Sprint(r.Sys.Sunrise)
+	}
+	if r.Sys.Sunset > 0 {
+		info.Sunset = fmt.Sprint(r.Sys.Sunset)
+	}
+	if len(r.Weather) > 0 {
+		info.CondTxt = r.Weather[0].Description
+	}
+	return info
+}
+
+// staticProvider serves weather from a JSON file, mainly for tests and demos.
+// An entry without coordinates applies to every location.
+type staticProvider struct {
+	path string
+}
+
+type StaticWeather struct {
+	Longitude float64        `json:"longitude"`
+	Latitude  float64        `json:"latitude"`
+	Data      WeatherInfo    `json:"data"`
+	Forecast  []ForecastInfo `json:"forecast"`
+}
+
+func (p *staticProvider) UpdateInterval() time.Duration {
+	return time.Minute
+}
+
+func (p *staticProvider) GetData(locations Locations) (map[string]WeatherInfo, error) {
+	buff, err := os.ReadFile(p.path)
+	if err != nil {
+		return nil, err
+	}
+	var entries []StaticWeather
+	if err = json.Unmarshal(buff, &entries); err != nil {
+		return nil, err
+	}
+
+	byKey := make(map[string]WeatherInfo)
+	var fallback *WeatherInfo
+	for i, entry := range entries {
+		if entry.Longitude == 0 && entry.Latitude == 0 {
+			fallback = &entries[i].Data
+			continue
+		}
+		byKey[(&Operation{Longitude: entry.Longitude, Latitude: entry.Latitude}).Key()] = entry.Data
+	}
+
+	data := make(map[string]WeatherInfo)
+	for _, opt := range locations {
+		if info, ok := byKey[opt.Key()]; ok {
+			data[opt.Key()] = info
+		} else if fallback != nil {
+			data[opt.Key()] = *fallback
+		}
+	}
+	return data, nil
+}
+
+func doJSON(client *http.Client, req *http.Request, v interface{}) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code is %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, v)
+}
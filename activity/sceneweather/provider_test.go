@@ -0,0 +1,187 @@
+package sceneweather
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testLocations Locations = []Operation{
+	{Longitude: 109.84041, Latitude: 40.65817},
+	{Longitude: 129.461205, Latitude: 35.42859},
+	{Longitude: 119.461205, Latitude: 35.42859},
+}
+
+func TestGizwitsProvider_GetData(t *testing.T) {
+	// The batch API replies in request order and echoes no coordinates.
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData []WeatherRequestData
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&reqData))
+
+		resp := WeatherResponse{}
+		for _, loc := range reqData {
+			resp.Data = append(resp.Data, WeatherInfo{Temperature: "20", CityName: (&Operation{Longitude: loc.Longitude, Latitude: loc.Latitude}).Key()})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	provider, err := newWeatherProvider(&Settings{WeatherUrl: server.URL})
+	assert.Nil(t, err)
+
+	data, err := provider.GetData(testLocations)
+	assert.Nil(t, err)
+	assert.Len(t, data, len(testLocations))
+	for _, loc := range testLocations {
+		assert.Equal(t, loc.Key(), data[loc.Key()].CityName)
+	}
+}
+
+func TestGizwitsProvider_GetDataError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = json.NewEncoder(w).Encode(WeatherResponse{Error: true, Message: "quota exceeded"})
+	}))
+	defer server.Close()
+
+	provider, err := newWeatherProvider(&Settings{WeatherUrl: server.URL})
+	assert.Nil(t, err)
+
+	_, err = provider.GetData(testLocations)
+	assert.NotNil(t, err)
+}
+
+func TestOpenWeatherProvider_GetData(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "secret", r.URL.Query().Get("appid"))
+		_, _ = w.Write([]byte(`{"id":1,"name":"Qingdao","timezone":28800,` +
+			`"weather":[{"main":"Rain","description":"light rain"}],` +
+			`"main":{"temp":21.5,"humidity":80,"pressure":1012},"wind":{"speed":3.1,"deg":90},` +
+			`"rain":{"1h":0.4},"sys":{"sunrise":1709246400,"sunset":1709287200}}`))
+	}))
+	defer server.Close()
+
+	provider, err := newWeatherProvider(&Settings{WeatherProvider: providerOpenWeather, WeatherUrl: server.URL, WeatherApiKey: "secret"})
+	assert.Nil(t, err)
+
+	data, err := provider.GetData(testLocations[:1])
+	assert.Nil(t, err)
+	info := data[testLocations[0].Key()]
+	assert.Equal(t, "21.5", info.Temperature)
+	assert.Equal(t, "light rain", info.CondTxt)
+	assert.Equal(t, "1709246400", info.Sunrise)
+	assert.Equal(t, "1709287200", info.Sunset)
+
+	// Urumqi keeps Beijing time, hours off the zone guessed from its longitude.
+	sunrise := &Operation{Left: "sr", Longitude: 87.6, Latitude: 43.8}
+	at, ok := sunrise.sunEvent(info, time.Unix(1709200000, 0))
+	assert.True(t, ok)
+	assert.Equal(t, int64(1709246400), at.Unix())
+}
+
+func TestStaticProvider_GetData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "weather.json")
+	assert.Nil(t, os.WriteFile(path, []byte(`[
+		{"longitude": 109.84041, "latitude": 40.65817, "data": {"temperature": "-5"}},
+		{"data": {"temperature": "25"}}
+	]`), 0644))
+
+	provider, err := newWeatherProvider(&Settings{WeatherProvider: providerStatic, WeatherFile: path})
+	assert.Nil(t, err)
+
+	data, err := provider.GetData(testLocations)
+	assert.Nil(t, err)
+	assert.Equal(t, "-5", data[testLocations[0].Key()].Temperature)
+	assert.Equal(t, "25", data[testLocations[1].Key()].Temperature)
+}
+
+func TestFetchWeather_Chunks(t *testing.T) {
+	var mu sync.Mutex
+	var batches []int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var reqData []WeatherRequestData
+		assert.Nil(t, json.NewDecoder(r.Body).Decode(&reqData))
+		mu.Lock()
+		batches = append(batches, len(reqData))
+		mu.Unlock()
+
+		// The chunk with the first location fails, the others reply in reverse order.
+		if reqData[0].Longitude == testLocations[0].Longitude {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		resp := WeatherResponse{}
+		for i := len(reqData) - 1; i >= 0; i-- {
+			resp.Data = append(resp.Data, WeatherInfo{
+				Temperature: fmt.Sprint(reqData[i].Longitude),
+				Latitude:    reqData[i].Latitude,
+				Longitude:   fmt.Sprint(reqData[i].Longitude),
+			})
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+	defer server.Close()
+
+	provider, err := newWeatherProvider(&Settings{WeatherUrl: server.URL})
+	assert.Nil(t, err)
+
+	locations := append(Locations{}, testLocations...)
+	locations = append(locations, Operation{Longitude: 100.5, Latitude: 30.5})
+	data, errs := fetchWeather(provider, locations, 2, 2)
+	assert.Len(t, errs, 1)
+	assert.ElementsMatch(t, []int{2, 2}, batches)
+	assert.Len(t, data, 2)
+	for _, loc := range locations[2:] {
+		assert.Equal(t, fmt.Sprint(loc.Longitude), data[loc.Key()].Temperature)
+	}
+}
+
+func TestMatchWeather_CityID(t *testing.T) {
+	cities := make(map[string]string)
+	results := []WeatherInfo{
+		{Temperature: "10", CityId: "c1", Latitude: testLocations[1].Latitude, Longitude: testLocations[1].Longitude},
+		{Temperature: "20"},
+	}
+
+	// Once a response echoes coordinates, the results without them are not
+	// matched by their position.
+	data, err := matchWeather(testLocations[:2], results, cities)
+	assert.NotNil(t, err)
+	assert.Len(t, data, 1)
+	assert.Equal(t, "10", data[testLocations[1].Key()].Temperature)
+	assert.Equal(t, map[string]string{testLocations[1].Key(): "c1"}, cities)
+
+	// Once its city is known, a location is matched by the city ID.
+	data, err = matchWeather(testLocations, []WeatherInfo{{Temperature: "30", CityId: "c2"}, {Temperature: "15", CityId: "c1"}}, cities)
+	assert.NotNil(t, err)
+	assert.Len(t, data, 1)
+	assert.Equal(t, "15", data[testLocations[1].Key()].Temperature)
+}
+
+func TestMatchWeather_Position(t *testing.T) {
+	// The Gizwits response shape, without coordinates.
+	var resp WeatherResponse
+	assert.Nil(t, json.Unmarshal([]byte(`{"error":false,"message":"","data":[`+
+		`{"temperature":"10","cityId":"c1","cityName":"Baotou"},`+
+		`{"temperature":"20","cityId":"c2","cityName":"Pohang"},`+
+		`{"temperature":"30","cityId":"c3","cityName":"Rizhao"}]}`), &resp))
+
+	data, err := matchWeather(testLocations, resp.Data, make(map[string]string))
+	assert.Nil(t, err)
+	assert.Len(t, data, 3)
+	for idx, loc := range testLocations {
+		assert.Equal(t, resp.Data[idx].Temperature, data[loc.Key()].Temperature)
+	}
+
+	// A short response cannot be matched by position.
+	data, err = matchWeather(testLocations, resp.Data[:1], make(map[string]string))
+	assert.NotNil(t, err)
+	assert.Len(t, data, 0)
+}
@@ -0,0 +1,47 @@
+package sceneweather
+
+import (
+	"math"
+	"time"
+)
+
+const (
+	julianUnixEpoch = 2440587.5
+	julian2000      = 2451545.0
+)
+
+// SunTimes computes the sunrise and sunset of the given date at a location
+// with the sunrise equation. ok is false during polar day or night.
+func SunTimes(latitude, longitude float64, date time.Time) (sunrise, sunset time.Time, ok bool) {
+	midnight := time.Date(date.Year(), date.Month(), date.Day(), 0, 0, 0, 0, time.UTC)
+	n := math.Ceil(float64(midnight.Unix())/86400 + julianUnixEpoch - julian2000 + 0.0008)
+
+	// Mean solar time, solar mean anomaly, equation of the center and ecliptic longitude.
+	meanSolar := n - longitude/360
+	anomaly := math.Mod(357.5291+0.98560028*meanSolar, 360)
+	center := 1.9148*sinDeg(anomaly) + 0.02*sinDeg(2*anomaly) + 0.0003*sinDeg(3*anomaly)
+	ecliptic := math.Mod(anomaly+center+180+102.9372, 360)
+	transit := julian2000 + meanSolar + 0.0053*sinDeg(anomaly) - 0.0069*sinDeg(2*ecliptic)
+
+	sinDeclination := sinDeg(ecliptic) * sinDeg(23.4397)
+	cosDeclination := math.Cos(math.Asin(sinDeclination))
+	cosHourAngle := (sinDeg(-0.833) - sinDeg(latitude)*sinDeclination) / (cosDeg(latitude) * cosDeclination)
+	if cosHourAngle < -1 || cosHourAngle > 1 {
+		return time.Time{}, time.Time{}, false
+	}
+	hourAngle := math.Acos(cosHourAngle) * 180 / math.Pi
+
+	return julianToTime(transit - hourAngle/360), julianToTime(transit + hourAngle/360), true
+}
+
+func julianToTime(j float64) time.Time {
+	return time.Unix(int64(math.Round((j-julianUnixEpoch)*86400)), 0).UTC()
+}
+
+func sinDeg(deg float64) float64 {
+	return math.Sin(deg * math.Pi / 180)
+}
+
+func cosDeg(deg float64) float64 {
+	return math.Cos(deg * math.Pi / 180)
+}
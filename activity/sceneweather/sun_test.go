@@ -0,0 +1,20 @@
+package sceneweather
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSunTimes(t *testing.T) {
+	beijing := time.FixedZone("CST", 8*3600)
+	sunrise, sunset, ok := SunTimes(39.9042, 116.4074, time.Date(2024, 6, 21, 0, 0, 0, 0, beijing))
+	assert.True(t, ok)
+	assert.WithinDuration(t, time.Date(2024, 6, 21, 4, 46, 0, 0, beijing), sunrise, 5*time.Minute)
+	assert.WithinDuration(t, time.Date(2024, 6, 21, 19, 46, 0, 0, beijing), sunset, 5*time.Minute)
+
+	// Polar night.
+	_, _, ok = SunTimes(78.2232, 15.6267, time.Date(2024, 12, 21, 0, 0, 0, 0, time.UTC))
+	assert.False(t, ok)
+}
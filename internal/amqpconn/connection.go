@@ -0,0 +1,181 @@
+// Package amqpconn keeps a RabbitMQ connection and its channel up for the
+// rabbitmq trigger and the rabbitmqpublish activity.
+package amqpconn
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/streadway/amqp"
+)
+
+var (
+	// MinReconnectDelay and MaxReconnectDelay bound the backoff between
+	// reconnect attempts.
+	MinReconnectDelay = 1 * time.Second
+	MaxReconnectDelay = 1 * time.Minute
+)
+
+// Channel is the part of *amqp.Channel the supervisor needs, users narrow
+// *amqp.Channel to the interface they need so that tests can run against a
+// fake broker.
+type Channel interface {
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// AMQPConnection is the part of *amqp.Connection used here, opening
+// channels of type C.
+type AMQPConnection[C Channel] interface {
+	Channel() (C, error)
+	NotifyClose(receiver chan *amqp.Error) chan *amqp.Error
+	Close() error
+}
+
+// Dialer opens a connection to the broker.
+type Dialer[C Channel] func() (AMQPConnection[C], error)
+
+// Connection supervises a broker connection and its channel. Whenever
+// either of them closes, it dials again with backoff and runs setup on the
+// fresh channel, so setup has to rebuild everything the channel carries:
+// qos, topology, consumers and confirms.
+type Connection[C Channel] struct {
+	dial   Dialer[C]
+	setup  func(channel C) error
+	logger log.Logger
+
+	mu      sync.Mutex
+	conn    AMQPConnection[C]
+	channel C
+	open    bool
+
+	done     chan struct{}
+	doneOnce sync.Once
+	running  sync.WaitGroup
+}
+
+// closing carries the close notifications of one connection and its channel.
+type closing struct {
+	conn    chan *amqp.Error
+	channel chan *amqp.Error
+}
+
+func NewConnection[C Channel](logger log.Logger, dial Dialer[C], setup func(channel C) error) *Connection[C] {
+	return &Connection[C]{
+		dial:   dial,
+		setup:  setup,
+		logger: logger,
+		done:   make(chan struct{}),
+	}
+}
+
+// Start connects and keeps the connection up until Close is called.
+func (c *Connection[C]) Start() error {
+	closing, err := c.connect()
+	if err != nil {
+		return err
+	}
+	c.running.Add(1)
+	go c.supervise(closing)
+	return nil
+}
+
+// Channel returns the current channel, the zero C (nil) while reconnecting.
+func (c *Connection[C]) Channel() C {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.channel
+}
+
+// Stop stops reconnecting, the current channel stays open until Close.
+func (c *Connection[C]) Stop() {
+	c.doneOnce.Do(func() { close(c.done) })
+	c.running.Wait()
+}
+
+// Close stops reconnecting and closes the channel and connection.
+func (c *Connection[C]) Close() {
+	c.Stop()
+	c.close()
+}
+
+func (c *Connection[C]) connect() (*closing, error) {
+	conn, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	closing := &closing{
+		conn:    conn.NotifyClose(make(chan *amqp.Error, 1)),
+		channel: channel.NotifyClose(make(chan *amqp.Error, 1)),
+	}
+	if err = c.setup(channel); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.conn, c.channel, c.open = conn, channel, true
+	c.mu.Unlock()
+	return closing, nil
+}
+
+func (c *Connection[C]) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.open {
+		_ = c.channel.Close()
+		var none C
+		c.channel, c.open = none, false
+	}
+	if c.conn != nil {
+		_ = c.conn.Close()
+		c.conn = nil
+	}
+}
+
+func (c *Connection[C]) supervise(closing *closing) {
+	defer c.running.Done()
+	for {
+		var closeErr *amqp.Error
+		select {
+		case <-c.done:
+			return
+		case closeErr = <-closing.conn:
+		case closeErr = <-closing.channel:
+		}
+		c.logger.Errorf("connection closed, reconnecting: %v", closeErr)
+		c.close()
+
+		for attempt := 0; ; attempt++ {
+			select {
+			case <-c.done:
+				return
+			case <-time.After(reconnectDelay(attempt)):
+			}
+			var err error
+			if closing, err = c.connect(); err == nil {
+				break
+			}
+			c.logger.Errorf("failed to reconnecting to RabbitMQ: %v", err)
+		}
+		c.logger.Infof("reconnected to RabbitMQ")
+	}
+}
+
+// reconnectDelay doubles with every attempt up to MaxReconnectDelay and is
+// drawn from the upper half of that bound, so that instances cut off by
+// the same broker restart do not reconnect in lockstep.
+func reconnectDelay(attempt int) time.Duration {
+	delay := MaxReconnectDelay
+	if attempt < 32 && MinReconnectDelay<<attempt < delay {
+		delay = MinReconnectDelay << attempt
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
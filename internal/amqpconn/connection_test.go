@@ -0,0 +1,214 @@
+package amqpconn
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker records the dials and hands out connections whose channels
+// can be closed as the broker would.
+type fakeBroker struct {
+	mu       sync.Mutex
+	failDial int
+	conns    []*fakeConnection
+	channels []*fakeChannel
+	calls    []string
+}
+
+func (b *fakeBroker) dial() (AMQPConnection[*fakeChannel], error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failDial > 0 {
+		b.failDial--
+		b.calls = append(b.calls, "dial failed")
+		return nil, errors.New("connection refused")
+	}
+	b.calls = append(b.calls, "dial")
+	conn := &fakeConnection{broker: b}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+func (b *fakeBroker) Calls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+// Channel returns the i-th channel opened, waiting for it.
+func (b *fakeBroker) Channel(t *testing.T, i int) *fakeChannel {
+	var channel *fakeChannel
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if len(b.channels) <= i {
+			return false
+		}
+		channel = b.channels[i]
+		return true
+	}, time.Second, time.Millisecond)
+	return channel
+}
+
+type fakeConnection struct {
+	broker  *fakeBroker
+	closing []chan *amqp.Error
+	closed  bool
+}
+
+func (c *fakeConnection) Channel() (*fakeChannel, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	channel := &fakeChannel{conn: c}
+	c.broker.channels = append(c.broker.channels, channel)
+	return channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.closing = append(c.closing, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown closes the connection and its channels as the broker would, err
+// is nil for a close requested by the client.
+func (c *fakeConnection) shutdown(err *amqp.Error) {
+	c.broker.mu.Lock()
+	if c.closed {
+		c.broker.mu.Unlock()
+		return
+	}
+	c.closed = true
+	var channels []*fakeChannel
+	for _, channel := range c.broker.channels {
+		if channel.conn == c {
+			channels = append(channels, channel)
+		}
+	}
+	closing := c.closing
+	c.broker.mu.Unlock()
+
+	for _, channel := range channels {
+		channel.shutdown(err)
+	}
+	notify(closing, err)
+}
+
+type fakeChannel struct {
+	conn    *fakeConnection
+	closing []chan *amqp.Error
+	closed  bool
+}
+
+func (c *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	c.closing = append(c.closing, receiver)
+	return receiver
+}
+
+func (c *fakeChannel) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeChannel) shutdown(err *amqp.Error) {
+	c.conn.broker.mu.Lock()
+	if c.closed {
+		c.conn.broker.mu.Unlock()
+		return
+	}
+	c.closed = true
+	closing := c.closing
+	c.conn.broker.mu.Unlock()
+	notify(closing, err)
+}
+
+func notify(closing []chan *amqp.Error, err *amqp.Error) {
+	for _, receiver := range closing {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+}
+
+func TestConnection_Reconnect(t *testing.T) {
+	MinReconnectDelay, MaxReconnectDelay = time.Millisecond, 4*time.Millisecond
+	broker := &fakeBroker{}
+	var mu sync.Mutex
+	var setups []*fakeChannel
+	conn := NewConnection(log.RootLogger(), broker.dial, func(channel *fakeChannel) error {
+		mu.Lock()
+		defer mu.Unlock()
+		setups = append(setups, channel)
+		return nil
+	})
+	assert.Nil(t, conn.Start())
+	assert.Equal(t, broker.Channel(t, 0), conn.Channel())
+
+	broker.mu.Lock()
+	broker.failDial = 2
+	broker.mu.Unlock()
+	broker.conns[0].shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restart"})
+	second := broker.Channel(t, 1)
+	assert.Eventually(t, func() bool { return conn.Channel() == second }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"dial", "dial failed", "dial failed", "dial"}, broker.Calls())
+
+	// A closed channel is rebuilt as well.
+	second.shutdown(&amqp.Error{Code: amqp.ChannelError, Reason: "precondition failed"})
+	third := broker.Channel(t, 2)
+	assert.Eventually(t, func() bool { return conn.Channel() == third }, time.Second, time.Millisecond)
+	mu.Lock()
+	assert.Equal(t, []*fakeChannel{broker.Channel(t, 0), second, third}, setups)
+	mu.Unlock()
+
+	conn.Close()
+	assert.Nil(t, conn.Channel())
+	assert.True(t, third.closed)
+	assert.True(t, broker.conns[2].closed)
+}
+
+func TestConnection_CloseWhileReconnecting(t *testing.T) {
+	MinReconnectDelay, MaxReconnectDelay = time.Hour, time.Hour
+	broker := &fakeBroker{}
+	conn := NewConnection(log.RootLogger(), broker.dial, func(channel *fakeChannel) error { return nil })
+	assert.Nil(t, conn.Start())
+
+	broker.conns[0].shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restart"})
+	done := make(chan struct{})
+	go func() {
+		conn.Close()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("close blocked on the reconnect backoff")
+	}
+	assert.Equal(t, []string{"dial"}, broker.Calls())
+}
+
+func TestReconnectDelay(t *testing.T) {
+	MinReconnectDelay, MaxReconnectDelay = time.Second, time.Minute
+	for attempt, bound := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second} {
+		delay := reconnectDelay(attempt)
+		assert.True(t, delay >= bound/2 && delay <= bound, "attempt %d delay %v", attempt, delay)
+	}
+	for _, attempt := range []int{6, 40, 100} {
+		delay := reconnectDelay(attempt)
+		assert.True(t, delay >= 30*time.Second && delay <= time.Minute, "attempt %d delay %v", attempt, delay)
+	}
+}
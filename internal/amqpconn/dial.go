@@ -0,0 +1,130 @@
+package amqpconn
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/streadway/amqp"
+)
+
+// DialOptions secure and authenticate the connections of a Dialer.
+type DialOptions struct {
+	// CACertFile, ClientCertFile and ClientKeyFile are PEM files for amqps.
+	CACertFile     string
+	ClientCertFile string
+	ClientKeyFile  string
+	ServerName     string
+	// SASLExternal authenticates with the client certificate.
+	SASLExternal bool
+	// PasswordFile and PasswordEnv replace the password of the URL, they are
+	// read on every dial so that rotated passwords are picked up.
+	PasswordFile string
+	PasswordEnv  string
+	// ConnectionName is shown for the connection in the management UI,
+	// along with Product.
+	ConnectionName string
+	Product        string
+}
+
+// DialAMQP returns a Dialer for the broker URL.
+func DialAMQP(url string, options DialOptions) (Dialer[*amqp.Channel], error) {
+	uri, err := amqp.ParseURI(url)
+	if err != nil {
+		return nil, err
+	}
+	// Fail early on options that can never work.
+	if _, err = options.config(uri); err != nil {
+		return nil, err
+	}
+	return func() (AMQPConnection[*amqp.Channel], error) {
+		config, err := options.config(uri)
+		if err != nil {
+			return nil, err
+		}
+		conn, err := amqp.DialConfig(url, config)
+		if err != nil {
+			return nil, err
+		}
+		return conn, nil
+	}, nil
+}
+
+func (o DialOptions) config(uri amqp.URI) (amqp.Config, error) {
+	var config amqp.Config
+	if o.ConnectionName != "" {
+		config.Properties = amqp.Table{
+			"product":         o.Product,
+			"connection_name": o.ConnectionName,
+		}
+	}
+
+	tlsConfig, err := o.tlsConfig()
+	if err != nil {
+		return config, err
+	}
+	if tlsConfig != nil && uri.Scheme != "amqps" {
+		return config, fmt.Errorf("TLS settings require an amqps URL")
+	}
+	config.TLSClientConfig = tlsConfig
+
+	switch {
+	case o.SASLExternal:
+		if tlsConfig == nil || len(tlsConfig.Certificates) == 0 {
+			return config, fmt.Errorf("SASL EXTERNAL requires a client certificate")
+		}
+		config.SASL = []amqp.Authentication{externalAuth{}}
+	case o.PasswordFile != "":
+		password, err := os.ReadFile(o.PasswordFile)
+		if err != nil {
+			return config, err
+		}
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: uri.Username, Password: strings.TrimSpace(string(password))}}
+	case o.PasswordEnv != "":
+		password, ok := os.LookupEnv(o.PasswordEnv)
+		if !ok {
+			return config, fmt.Errorf("environment variable %s is not set", o.PasswordEnv)
+		}
+		config.SASL = []amqp.Authentication{&amqp.PlainAuth{Username: uri.Username, Password: password}}
+	}
+	return config, nil
+}
+
+func (o DialOptions) tlsConfig() (*tls.Config, error) {
+	if o.CACertFile == "" && o.ClientCertFile == "" && o.ClientKeyFile == "" && o.ServerName == "" {
+		return nil, nil
+	}
+	config := &tls.Config{ServerName: o.ServerName}
+	if o.CACertFile != "" {
+		pem, err := os.ReadFile(o.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", o.CACertFile)
+		}
+	}
+	if o.ClientCertFile != "" || o.ClientKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.ClientCertFile, o.ClientKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// externalAuth is the SASL EXTERNAL mechanism, the broker takes the
+// identity from the client certificate.
+type externalAuth struct{}
+
+func (externalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+func (externalAuth) Response() string {
+	return ""
+}
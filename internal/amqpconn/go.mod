@@ -0,0 +1,18 @@
+module github.com/insrat/gf-plugins/internal/amqpconn
+
+go 1.21.0
+
+require (
+	github.com/project-flogo/core v1.6.7
+	github.com/streadway/amqp v1.1.0
+	github.com/stretchr/testify v1.8.4
+)
+
+require (
+	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	go.uber.org/atomic v1.6.0 // indirect
+	go.uber.org/multierr v1.5.0 // indirect
+	go.uber.org/zap v1.16.0 // indirect
+	gopkg.in/yaml.v3 v3.0.1 // indirect
+)
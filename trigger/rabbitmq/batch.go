@@ -0,0 +1,84 @@
+package rabbitmq
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// handleBatches gathers messages until the batch is full or the batch
+// timeout passes since its first message, and hands them to the handlers
+// at once. It is the only worker in batch mode, as acking a whole batch
+// with multiple set also acks every earlier message of the channel.
+func (t *Trigger) handleBatches(queue chan message) {
+	defer t.workers.Done()
+	var batch []message
+	var timeout <-chan time.Time
+	flush := func() {
+		t.handleBatch(batch)
+		batch, timeout = nil, nil
+	}
+	for {
+		select {
+		case <-t.shutdown:
+			flush()
+			return
+		case <-timeout:
+			flush()
+		case m := <-queue:
+			if m.err != nil {
+				if !t.settings.NoAck {
+					t.deadLetter(m.delivery, fmt.Sprintf("invalid message: %v", m.err))
+				}
+				continue
+			}
+			// Delivery tags belong to a channel, a batch never spans reconnects.
+			if len(batch) > 0 && batch[0].delivery.Acknowledger != m.delivery.Acknowledger {
+				flush()
+			}
+			batch = append(batch, m)
+			if len(batch) == 1 {
+				timeout = time.After(t.batchTimeout)
+			}
+			if len(batch) >= t.settings.BatchSize {
+				flush()
+			}
+		}
+	}
+}
+
+// handleBatch runs every handler once with the messages it matches. A
+// batch succeeds or fails as a whole: it is acked at once when every
+// handler succeeds, otherwise each message is retried on its own as set
+// up by the redelivery settings.
+func (t *Trigger) handleBatch(batch []message) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for _, handler := range t.handlers {
+		var messages []interface{}
+		for _, m := range batch {
+			messages = append(messages, handler.filter.Events(routingKey(m.delivery), m.data)...)
+		}
+		if len(messages) == 0 {
+			continue
+		}
+		if _, err = handler.Handle(context.Background(), &Output{Messages: messages}); err != nil {
+			t.logger.Errorf("run action for handler [%s] failed for reason [%s] retry batch of %d messages", handler.Name(), err, len(batch))
+			break
+		}
+	}
+
+	if t.settings.NoAck {
+		return
+	}
+	if err == nil {
+		_ = batch[len(batch)-1].delivery.Ack(true)
+		return
+	}
+	for _, m := range batch {
+		t.retry(m.delivery)
+	}
+}
@@ -0,0 +1,96 @@
+package rabbitmq
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBatch_Size(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{}
+	trg := newFakeTrigger(&Settings{QueueName: "scene", BatchSize: 3}, broker, handler)
+	trg.batchTimeout = time.Hour
+	assert.Nil(t, trg.Start())
+	defer func() { assert.Nil(t, trg.Stop()) }()
+
+	for _, mac := range []string{"m1", "m2", "m3"} {
+		broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"` + mac + `"}`)
+	}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack multiple 3"}, broker.Acks())
+	assert.Equal(t, 1, handler.Count())
+	messages := handler.data[0].(*Output).Messages
+	assert.Len(t, messages, 3)
+	assert.Equal(t, "m3", messages[2].(map[string]interface{})["deviceMac"])
+}
+
+func TestBatch_Timeout(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{}
+	trg := newFakeTrigger(&Settings{QueueName: "scene", BatchSize: 10}, broker, handler)
+	trg.batchTimeout = 20 * time.Millisecond
+	assert.Nil(t, trg.Start())
+	defer func() { assert.Nil(t, trg.Stop()) }()
+
+	broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"m1"}`)
+	broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"m2"}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack multiple 2"}, broker.Acks())
+	assert.Len(t, handler.data[0].(*Output).Messages, 2)
+}
+
+func TestBatch_Failure(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{err: errors.New("failed")}
+	trg := newFakeTrigger(&Settings{QueueName: "scene", BatchSize: 2}, broker, handler)
+	trg.batchTimeout = time.Hour
+	assert.Nil(t, trg.Start())
+	defer func() { assert.Nil(t, trg.Stop()) }()
+
+	// The invalid message is dead-lettered on its own, the failed batch
+	// is retried message by message.
+	broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"m1"}`)
+	broker.Channel(t, 0).Deliver(`not json`)
+	broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"m2"}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"nack", "nack requeue", "nack requeue"}, broker.Acks())
+	assert.Equal(t, 1, handler.Count())
+}
+
+func TestBatch_Filter(t *testing.T) {
+	broker := &fakeBroker{}
+	online := &filteredHandler{fakeHandler: &fakeHandler{}, settings: map[string]interface{}{"eventType": "device_online"}}
+	offline := &filteredHandler{fakeHandler: &fakeHandler{}, settings: map[string]interface{}{"eventType": "device_offline"}}
+	trg := newFakeTrigger(&Settings{QueueName: "scene", BatchSize: 3}, broker, online, offline)
+	trg.batchTimeout = time.Hour
+	assert.Nil(t, trg.Start())
+	defer func() { assert.Nil(t, trg.Stop()) }()
+
+	broker.Channel(t, 0).Deliver(`{"mac":"m1","event_type":"device_online"}`)
+	broker.Channel(t, 0).Deliver(`{"mac":"m2","event_type":"device_online"}`)
+	broker.Channel(t, 0).Deliver(`{"mac":"m3","event_type":"device_status_kv"}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Len(t, online.data[0].(*Output).Messages, 2)
+	assert.Equal(t, 0, offline.Count())
+}
+
+func TestBatch_Array(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{}
+	trg := newFakeTrigger(&Settings{QueueName: "scene", BatchSize: 2}, broker, handler)
+	trg.batchTimeout = time.Hour
+	assert.Nil(t, trg.Start())
+	defer func() { assert.Nil(t, trg.Stop()) }()
+
+	// The events of an array message join the batch one by one.
+	broker.Channel(t, 0).Deliver(`[{"mac":"m1"},{"mac":"m2"}]`)
+	broker.Channel(t, 0).Deliver(`{"mac":"m3"}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack multiple 2"}, broker.Acks())
+	messages := handler.data[0].(*Output).Messages
+	assert.Len(t, messages, 3)
+	assert.Equal(t, "m2", messages[1].(map[string]interface{})["deviceMac"])
+}
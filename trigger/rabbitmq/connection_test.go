@@ -0,0 +1,268 @@
+package rabbitmq
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/insrat/gf-plugins/internal/amqpconn"
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeBroker records what connections and channels were asked to do.
+type fakeBroker struct {
+	mu        sync.Mutex
+	failDial  int
+	conns     []*fakeConnection
+	channels  []*fakeChannel
+	calls     []string
+	acks      []string
+	published []amqp.Publishing
+}
+
+func (b *fakeBroker) dial() (amqpconn.AMQPConnection[AMQPChannel], error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.failDial > 0 {
+		b.failDial--
+		b.calls = append(b.calls, "dial failed")
+		return nil, errors.New("connection refused")
+	}
+	b.calls = append(b.calls, "dial")
+	conn := &fakeConnection{broker: b}
+	b.conns = append(b.conns, conn)
+	return conn, nil
+}
+
+func (b *fakeBroker) record(call string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.calls = append(b.calls, call)
+}
+
+func (b *fakeBroker) Calls() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.calls...)
+}
+
+func (b *fakeBroker) Acks() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.acks...)
+}
+
+func (b *fakeBroker) Published() []amqp.Publishing {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]amqp.Publishing(nil), b.published...)
+}
+
+// Channel returns the i-th channel opened, waiting for it to be consumed.
+func (b *fakeBroker) Channel(t *testing.T, i int) *fakeChannel {
+	var channel *fakeChannel
+	assert.Eventually(t, func() bool {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if len(b.channels) <= i || b.channels[i].deliveries == nil {
+			return false
+		}
+		channel = b.channels[i]
+		return true
+	}, time.Second, time.Millisecond)
+	return channel
+}
+
+type fakeConnection struct {
+	broker  *fakeBroker
+	closing []chan *amqp.Error
+	closed  bool
+}
+
+func (c *fakeConnection) Channel() (AMQPChannel, error) {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	channel := &fakeChannel{conn: c}
+	c.broker.channels = append(c.broker.channels, channel)
+	return channel, nil
+}
+
+func (c *fakeConnection) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.broker.mu.Lock()
+	defer c.broker.mu.Unlock()
+	c.closing = append(c.closing, receiver)
+	return receiver
+}
+
+func (c *fakeConnection) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+// shutdown closes the connection as the broker would, err is nil for a
+// close requested by the client.
+func (c *fakeConnection) shutdown(err *amqp.Error) {
+	c.broker.mu.Lock()
+	if c.closed {
+		c.broker.mu.Unlock()
+		return
+	}
+	c.closed = true
+	var channels []*fakeChannel
+	for _, channel := range c.broker.channels {
+		if channel.conn == c {
+			channels = append(channels, channel)
+		}
+	}
+	closing := c.closing
+	c.broker.mu.Unlock()
+
+	for _, channel := range channels {
+		channel.shutdown(err)
+	}
+	for _, receiver := range closing {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+}
+
+type fakeChannel struct {
+	conn       *fakeConnection
+	closing    []chan *amqp.Error
+	deliveries chan amqp.Delivery
+	closed     bool
+	tag        uint64
+}
+
+func (c *fakeChannel) Qos(prefetchCount, prefetchSize int, global bool) error {
+	c.conn.broker.record("qos")
+	return nil
+}
+
+func (c *fakeChannel) QueueDeclare(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if args == nil {
+		c.conn.broker.record("declare " + name)
+	} else {
+		c.conn.broker.record(fmt.Sprintf("declare %s %v", name, args))
+	}
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) QueueDeclarePassive(name string, durable, autoDelete, exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	c.conn.broker.record("check " + name)
+	return amqp.Queue{Name: name}, nil
+}
+
+func (c *fakeChannel) ExchangeDeclare(name, kind string, durable, autoDelete, internal, noWait bool, args amqp.Table) error {
+	c.conn.broker.record("exchange " + name + " " + kind)
+	return nil
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.conn.broker.record(fmt.Sprintf("publish %q %s %v", exchange, key, msg.Headers[redeliveryHeader]))
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	c.conn.broker.published = append(c.conn.broker.published, msg)
+	return nil
+}
+
+func (c *fakeChannel) QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error {
+	c.conn.broker.record("bind " + name + " " + key + " " + exchange)
+	return nil
+}
+
+func (c *fakeChannel) Consume(queue, consumer string, autoAck, exclusive, noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	c.conn.broker.calls = append(c.conn.broker.calls, "consume "+queue)
+	c.deliveries = make(chan amqp.Delivery, 16)
+	return c.deliveries, nil
+}
+
+// Cancel stops the consumer, the broker closes its deliveries.
+func (c *fakeChannel) Cancel(consumer string, noWait bool) error {
+	c.conn.broker.mu.Lock()
+	c.conn.broker.calls = append(c.conn.broker.calls, "cancel "+consumer)
+	deliveries := c.deliveries
+	c.deliveries = nil
+	c.conn.broker.mu.Unlock()
+	if deliveries != nil {
+		close(deliveries)
+	}
+	return nil
+}
+
+func (c *fakeChannel) NotifyClose(receiver chan *amqp.Error) chan *amqp.Error {
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	c.closing = append(c.closing, receiver)
+	return receiver
+}
+
+func (c *fakeChannel) Close() error {
+	c.shutdown(nil)
+	return nil
+}
+
+func (c *fakeChannel) shutdown(err *amqp.Error) {
+	c.conn.broker.mu.Lock()
+	if c.closed {
+		c.conn.broker.mu.Unlock()
+		return
+	}
+	c.closed = true
+	closing := c.closing
+	deliveries := c.deliveries
+	c.deliveries = nil
+	c.conn.broker.mu.Unlock()
+
+	if deliveries != nil {
+		close(deliveries)
+	}
+	for _, receiver := range closing {
+		if err != nil {
+			receiver <- err
+		}
+		close(receiver)
+	}
+}
+
+// Deliver sends a message to the consumer of the channel.
+func (c *fakeChannel) Deliver(body string) {
+	c.conn.broker.mu.Lock()
+	c.tag++
+	tag := c.tag
+	c.conn.broker.mu.Unlock()
+	c.deliveries <- amqp.Delivery{Acknowledger: c, DeliveryTag: tag, Body: []byte(body)}
+}
+
+func (c *fakeChannel) Ack(tag uint64, multiple bool) error {
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	if multiple {
+		c.conn.broker.acks = append(c.conn.broker.acks, fmt.Sprintf("ack multiple %d", tag))
+	} else {
+		c.conn.broker.acks = append(c.conn.broker.acks, "ack")
+	}
+	return nil
+}
+
+func (c *fakeChannel) Nack(tag uint64, multiple bool, requeue bool) error {
+	c.conn.broker.mu.Lock()
+	defer c.conn.broker.mu.Unlock()
+	if requeue {
+		c.conn.broker.acks = append(c.conn.broker.acks, "nack requeue")
+	} else {
+		c.conn.broker.acks = append(c.conn.broker.acks, "nack")
+	}
+	return nil
+}
+
+func (c *fakeChannel) Reject(tag uint64, requeue bool) error {
+	return c.Nack(tag, false, requeue)
+}
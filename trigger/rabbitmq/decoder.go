@@ -0,0 +1,363 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/streadway/amqp"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	decoderAuto        = "auto"
+	decoderJSON        = "json"
+	decoderCloudEvents = "cloudevents"
+	decoderProtobuf    = "protobuf"
+	decoderRaw         = "raw"
+)
+
+const defaultMaxDecompressedSize = 16 << 20
+
+// Decoder fills the output from a message body.
+type Decoder interface {
+	Decode(body []byte, out *Output) error
+}
+
+// decoders picks the decoder of a message, by its content type in auto mode.
+type decoders struct {
+	fixed  Decoder
+	byType map[string]Decoder
+	// maxSize bounds decompressed bodies.
+	maxSize int64
+}
+
+func newDecoders(s *Settings) (*decoders, error) {
+	var protobuf Decoder
+	if s.ProtoDescriptorSet != "" {
+		message, err := loadMessageType(s.ProtoDescriptorSet, s.ProtoMessage)
+		if err != nil {
+			return nil, err
+		}
+		protobuf = protobufDecoder{message: message}
+	}
+
+	d := &decoders{
+		byType: map[string]Decoder{
+			"application/json":             jsonDecoder{},
+			"text/json":                    jsonDecoder{},
+			"application/cloudevents+json": cloudEventsDecoder{},
+		},
+		maxSize: s.MaxDecompressedSize,
+	}
+	if d.maxSize <= 0 {
+		d.maxSize = defaultMaxDecompressedSize
+	}
+	if protobuf != nil {
+		d.byType["application/protobuf"] = protobuf
+		d.byType["application/x-protobuf"] = protobuf
+		d.byType["application/vnd.google.protobuf"] = protobuf
+	}
+	switch s.Decoder {
+	case "", decoderJSON:
+		d.fixed = jsonDecoder{}
+	case decoderCloudEvents:
+		d.fixed = cloudEventsDecoder{}
+	case decoderProtobuf:
+		if protobuf == nil {
+			return nil, fmt.Errorf("the protobuf decoder requires a descriptor set")
+		}
+		d.fixed = protobuf
+	case decoderRaw:
+		d.fixed = rawDecoder{}
+	case decoderAuto:
+	default:
+		return nil, fmt.Errorf("unsupported decoder %s", s.Decoder)
+	}
+	return d, nil
+}
+
+// Decode decompresses the message and decodes it into the output, which
+// always carries the body and headers.
+func (d *decoders) Decode(delivery amqp.Delivery) (*Output, error) {
+	body, err := decompress(delivery.ContentEncoding, delivery.Body, d.maxSize)
+	if err != nil {
+		return nil, err
+	}
+	out := &Output{RawBody: body, Headers: fromTable(delivery.Headers)}
+	decoder := d.fixed
+	if decoder == nil {
+		decoder = d.forType(delivery.ContentType)
+	}
+	if err = decoder.Decode(body, out); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// forType returns the decoder of a content type. Messages without one,
+// as Gizwits sends them, are JSON and unknown types are raw.
+func (d *decoders) forType(contentType string) Decoder {
+	if contentType == "" {
+		return jsonDecoder{}
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return rawDecoder{}
+	}
+	if decoder, ok := d.byType[mediaType]; ok {
+		return decoder
+	}
+	return rawDecoder{}
+}
+
+// decompress refuses bodies that grow over maxSize, so that a small
+// message cannot expand without bound.
+func decompress(encoding string, body []byte, maxSize int64) ([]byte, error) {
+	switch strings.ToLower(encoding) {
+	case "", "identity":
+		return body, nil
+	case "gzip":
+		r, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		out, err := io.ReadAll(io.LimitReader(r, maxSize+1))
+		if err != nil {
+			return nil, err
+		}
+		if int64(len(out)) > maxSize {
+			return nil, fmt.Errorf("decompressed message is larger than %d bytes", maxSize)
+		}
+		return out, nil
+	default:
+		return nil, fmt.Errorf("unsupported content encoding %s", encoding)
+	}
+}
+
+// jsonDecoder decodes a JSON event, or a JSON array of them as batched
+// messages carry, each of which keeps the headers of the message.
+type jsonDecoder struct{}
+
+func (jsonDecoder) Decode(body []byte, out *Output) error {
+	if trimmed := bytes.TrimSpace(body); len(trimmed) == 0 || trimmed[0] != '[' {
+		return json.Unmarshal(body, out)
+	}
+	var elements []json.RawMessage
+	if err := json.Unmarshal(body, &elements); err != nil {
+		return err
+	}
+	out.Messages = make([]interface{}, 0, len(elements))
+	for _, element := range elements {
+		event := &Output{RawBody: element, Headers: out.Headers}
+		if err := json.Unmarshal(element, event); err != nil {
+			return err
+		}
+		out.Messages = append(out.Messages, event)
+	}
+	return nil
+}
+
+// events returns the events of a decoded message: the elements of an
+// array message, otherwise the message itself.
+func (o *Output) events() []*Output {
+	if o.Messages == nil {
+		return []*Output{o}
+	}
+	events := make([]*Output, 0, len(o.Messages))
+	for _, m := range o.Messages {
+		if event, ok := m.(*Output); ok {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// cloudEventsDecoder decodes structured CloudEvents, whose data holds the
+// event and whose attributes fill in the type and time it lacks.
+type cloudEventsDecoder struct{}
+
+type cloudEvent struct {
+	SpecVersion string          `json:"specversion"`
+	Type        string          `json:"type"`
+	Time        string          `json:"time"`
+	Data        json.RawMessage `json:"data"`
+}
+
+func (cloudEventsDecoder) Decode(body []byte, out *Output) error {
+	event := &cloudEvent{}
+	if err := json.Unmarshal(body, event); err != nil {
+		return err
+	}
+	if event.SpecVersion == "" {
+		return fmt.Errorf("not a CloudEvent: missing specversion")
+	}
+	if len(event.Data) > 0 {
+		if err := json.Unmarshal(event.Data, out); err != nil {
+			return err
+		}
+	}
+	if out.EventType == "" {
+		out.EventType = event.Type
+	}
+	if out.EventTime == 0 && event.Time != "" {
+		// Event times are unix seconds.
+		if t, err := time.Parse(time.RFC3339Nano, event.Time); err == nil {
+			out.EventTime = float64(t.UnixNano()) / 1e9
+		}
+	}
+	return nil
+}
+
+// protobufDecoder decodes a message of the descriptor set through its JSON
+// form, so that fields named like the JSON events fill the output.
+type protobufDecoder struct {
+	message protoreflect.MessageType
+}
+
+func (d protobufDecoder) Decode(body []byte, out *Output) error {
+	message := d.message.New().Interface()
+	if err := proto.Unmarshal(body, message); err != nil {
+		return err
+	}
+	data, err := protojson.MarshalOptions{UseProtoNames: true}.Marshal(message)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var v interface{}
+	if err = decoder.Decode(&v); err != nil {
+		return err
+	}
+	if data, err = json.Marshal(protoNumbers(d.message.Descriptor(), v)); err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// protoNumbers turns the 64-bit integers, which protojson writes as
+// strings, back into numbers by following the fields of the message.
+func protoNumbers(message protoreflect.MessageDescriptor, v interface{}) interface{} {
+	if message.ParentFile().Package() == "google.protobuf" {
+		// Well-known types have JSON forms of their own, only the 64-bit
+		// wrappers hold such strings.
+		switch message.FullName() {
+		case "google.protobuf.Int64Value", "google.protobuf.UInt64Value":
+			if s, ok := v.(string); ok {
+				return json.Number(s)
+			}
+		}
+		return v
+	}
+	object, ok := v.(map[string]interface{})
+	if !ok {
+		return v
+	}
+	fields := message.Fields()
+	for name, value := range object {
+		field := fields.ByName(protoreflect.Name(name))
+		if field == nil {
+			continue
+		}
+		switch {
+		case field.IsList():
+			if list, ok := value.([]interface{}); ok {
+				for i := range list {
+					list[i] = protoNumber(field, list[i])
+				}
+			}
+		case field.IsMap():
+			if m, ok := value.(map[string]interface{}); ok {
+				for k := range m {
+					m[k] = protoNumber(field.MapValue(), m[k])
+				}
+			}
+		default:
+			object[name] = protoNumber(field, value)
+		}
+	}
+	return object
+}
+
+func protoNumber(field protoreflect.FieldDescriptor, v interface{}) interface{} {
+	switch field.Kind() {
+	case protoreflect.Int64Kind, protoreflect.Sint64Kind, protoreflect.Sfixed64Kind,
+		protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+		if s, ok := v.(string); ok {
+			return json.Number(s)
+		}
+	case protoreflect.MessageKind, protoreflect.GroupKind:
+		return protoNumbers(field.Message(), v)
+	}
+	return v
+}
+
+// rawDecoder leaves the message to the handlers as raw body and headers.
+type rawDecoder struct{}
+
+func (rawDecoder) Decode(body []byte, out *Output) error {
+	return nil
+}
+
+func loadMessageType(file, name string) (protoreflect.MessageType, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	set := &descriptorpb.FileDescriptorSet{}
+	if err = proto.Unmarshal(data, set); err != nil {
+		return nil, err
+	}
+	files, err := protodesc.NewFiles(set)
+	if err != nil {
+		return nil, err
+	}
+	desc, err := files.FindDescriptorByName(protoreflect.FullName(name))
+	if err != nil {
+		return nil, err
+	}
+	message, ok := desc.(protoreflect.MessageDescriptor)
+	if !ok {
+		return nil, fmt.Errorf("%s is not a message", name)
+	}
+	return dynamicpb.NewMessageType(message), nil
+}
+
+// fromTable converts AMQP headers to plain maps for the flows.
+func fromTable(table amqp.Table) map[string]interface{} {
+	if table == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(table))
+	for k, v := range table {
+		out[k] = fromValue(v)
+	}
+	return out
+}
+
+func fromValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case amqp.Table:
+		return fromTable(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i := range v {
+			out[i] = fromValue(v[i])
+		}
+		return out
+	}
+	return v
+}
@@ -0,0 +1,160 @@
+package rabbitmq
+
+import (
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/streadway/amqp"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/descriptorpb"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+func TestDecoders_JSON(t *testing.T) {
+	d, err := newDecoders(&Settings{})
+	assert.Nil(t, err)
+
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	_, _ = w.Write([]byte(`{"product_key":"pk","event_type":"device_online","data":{"power":true}}`))
+	assert.Nil(t, w.Close())
+
+	out, err := d.Decode(amqp.Delivery{ContentEncoding: "gzip", Body: body.Bytes(), Headers: amqp.Table{"x-death": []interface{}{amqp.Table{"count": int64(1)}}}})
+	assert.Nil(t, err)
+	assert.Equal(t, "pk", out.ProductKey)
+	assert.Equal(t, map[string]interface{}{"power": true}, out.EventData)
+	assert.Equal(t, `{"product_key":"pk","event_type":"device_online","data":{"power":true}}`, string(out.RawBody))
+	assert.Equal(t, []interface{}{map[string]interface{}{"count": int64(1)}}, out.Headers["x-death"])
+
+	body.Reset()
+	w = gzip.NewWriter(&body)
+	_, _ = w.Write(bytes.Repeat([]byte(" "), 2048))
+	assert.Nil(t, w.Close())
+	d, err = newDecoders(&Settings{MaxDecompressedSize: 1024})
+	assert.Nil(t, err)
+	_, err = d.Decode(amqp.Delivery{ContentEncoding: "gzip", Body: body.Bytes()})
+	assert.EqualError(t, err, "decompressed message is larger than 1024 bytes")
+
+	_, err = d.Decode(amqp.Delivery{ContentEncoding: "br", Body: []byte(`{}`)})
+	assert.EqualError(t, err, "unsupported content encoding br")
+	_, err = d.Decode(amqp.Delivery{Body: []byte(`not json`)})
+	assert.NotNil(t, err)
+}
+
+func TestDecoders_JSONArray(t *testing.T) {
+	d, err := newDecoders(&Settings{})
+	assert.Nil(t, err)
+
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	_, _ = w.Write([]byte(` [{"product_key":"pk","mac":"m1","event_type":"device_online"},{"product_key":"pk","mac":"m2","event_type":"device_offline"}]`))
+	assert.Nil(t, w.Close())
+
+	out, err := d.Decode(amqp.Delivery{ContentEncoding: "gzip", Body: body.Bytes(), Headers: amqp.Table{"source": "snoti"}})
+	assert.Nil(t, err)
+	events := out.events()
+	assert.Len(t, events, 2)
+	assert.Equal(t, "m1", events[0].DeviceMac)
+	assert.Equal(t, "device_offline", events[1].EventType)
+	assert.Equal(t, `{"product_key":"pk","mac":"m2","event_type":"device_offline"}`, string(events[1].RawBody))
+	assert.Equal(t, "snoti", events[1].Headers["source"])
+
+	out, err = d.Decode(amqp.Delivery{Body: []byte(`[]`)})
+	assert.Nil(t, err)
+	assert.Empty(t, out.events())
+	_, err = d.Decode(amqp.Delivery{Body: []byte(`[{"mac":"m1"},"m2"]`)})
+	assert.NotNil(t, err)
+}
+
+func TestDecoders_Auto(t *testing.T) {
+	d, err := newDecoders(&Settings{Decoder: "auto"})
+	assert.Nil(t, err)
+
+	out, err := d.Decode(amqp.Delivery{
+		ContentType: "application/cloudevents+json; charset=utf-8",
+		Body:        []byte(`{"specversion":"1.0","type":"device_online","time":"2024-01-02T03:04:05.5Z","data":{"mac":"m1"}}`),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "device_online", out.EventType)
+	assert.Equal(t, "m1", out.DeviceMac)
+	assert.Equal(t, 1704164645.5, out.EventTime)
+
+	out, err = d.Decode(amqp.Delivery{ContentType: "application/json", Body: []byte(`{"event_type":"device_offline"}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, "device_offline", out.EventType)
+
+	// Messages without a content type are JSON.
+	out, err = d.Decode(amqp.Delivery{Body: []byte(`{"product_key":"pk","event_type":"device_online"}`)})
+	assert.Nil(t, err)
+	assert.Equal(t, "pk", out.ProductKey)
+
+	// Unknown content types reach the handlers raw.
+	out, err = d.Decode(amqp.Delivery{ContentType: "text/plain", Body: []byte(`hello`)})
+	assert.Nil(t, err)
+	assert.Equal(t, &Output{RawBody: []byte(`hello`)}, out)
+
+	_, err = newDecoders(&Settings{Decoder: "protobuf"})
+	assert.EqualError(t, err, "the protobuf decoder requires a descriptor set")
+	_, err = newDecoders(&Settings{Decoder: "xml"})
+	assert.EqualError(t, err, "unsupported decoder xml")
+}
+
+func TestDecoders_Protobuf(t *testing.T) {
+	field := func(name string, number int32, kind descriptorpb.FieldDescriptorProto_Type) *descriptorpb.FieldDescriptorProto {
+		return &descriptorpb.FieldDescriptorProto{
+			Name:   proto.String(name),
+			Number: proto.Int32(number),
+			Type:   kind.Enum(),
+			Label:  descriptorpb.FieldDescriptorProto_LABEL_OPTIONAL.Enum(),
+		}
+	}
+	set := &descriptorpb.FileDescriptorSet{File: []*descriptorpb.FileDescriptorProto{{
+		Name:    proto.String("gateway/event.proto"),
+		Package: proto.String("gateway"),
+		Syntax:  proto.String("proto3"),
+		MessageType: []*descriptorpb.DescriptorProto{{
+			Name: proto.String("Event"),
+			Field: []*descriptorpb.FieldDescriptorProto{
+				field("product_key", 1, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("event_type", 2, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+				field("created_at", 3, descriptorpb.FieldDescriptorProto_TYPE_INT64),
+				field("mac", 4, descriptorpb.FieldDescriptorProto_TYPE_STRING),
+			},
+		}},
+	}}}
+	data, err := proto.Marshal(set)
+	assert.Nil(t, err)
+	file := filepath.Join(t.TempDir(), "gateway.pb")
+	assert.Nil(t, os.WriteFile(file, data, 0600))
+
+	settings := &Settings{Decoder: "protobuf", ProtoDescriptorSet: file, ProtoMessage: "gateway.Event"}
+	d, err := newDecoders(settings)
+	assert.Nil(t, err)
+
+	messageType, err := loadMessageType(file, "gateway.Event")
+	assert.Nil(t, err)
+	message := dynamicpb.NewMessage(messageType.Descriptor())
+	fields := messageType.Descriptor().Fields()
+	message.Set(fields.ByName("product_key"), protoreflect.ValueOf("pk"))
+	message.Set(fields.ByName("event_type"), protoreflect.ValueOf("device_status_kv"))
+	message.Set(fields.ByName("created_at"), protoreflect.ValueOfInt64(1704164645))
+	message.Set(fields.ByName("mac"), protoreflect.ValueOf("112233"))
+	body, err := proto.Marshal(message)
+	assert.Nil(t, err)
+
+	out, err := d.Decode(amqp.Delivery{Body: body})
+	assert.Nil(t, err)
+	assert.Equal(t, "pk", out.ProductKey)
+	assert.Equal(t, "device_status_kv", out.EventType)
+	assert.Equal(t, float64(1704164645), out.EventTime)
+	assert.Equal(t, "112233", out.DeviceMac)
+
+	settings.ProtoMessage = "gateway.Missing"
+	_, err = newDecoders(settings)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,104 @@
+package rabbitmq
+
+import (
+	"strings"
+
+	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/trigger"
+)
+
+// handler is a trigger handler with the filter of its settings.
+type handler struct {
+	trigger.Handler
+	filter *filter
+}
+
+func newHandlers(handlers []trigger.Handler) ([]*handler, error) {
+	var out []*handler
+	for _, h := range handlers {
+		s := &HandlerSettings{}
+		if err := metadata.MapToStruct(h.Settings(), s, true); err != nil {
+			return nil, err
+		}
+		out = append(out, &handler{Handler: h, filter: newFilter(s)})
+	}
+	return out, nil
+}
+
+// filter selects the messages of a handler, empty fields match everything.
+type filter struct {
+	routingKey  []string
+	eventTypes  map[string]bool
+	productKeys map[string]bool
+}
+
+func newFilter(s *HandlerSettings) *filter {
+	f := &filter{
+		eventTypes:  splitSet(s.EventType),
+		productKeys: splitSet(s.ProductKey),
+	}
+	if s.RoutingKey != "" {
+		f.routingKey = strings.Split(s.RoutingKey, ".")
+	}
+	return f
+}
+
+// Match reports whether the message routed by routingKey belongs to the handler.
+func (f *filter) Match(routingKey string, data *Output) bool {
+	if f.routingKey != nil && !matchTopic(f.routingKey, strings.Split(routingKey, ".")) {
+		return false
+	}
+	if f.eventTypes != nil && !f.eventTypes[data.EventType] {
+		return false
+	}
+	if f.productKeys != nil && !f.productKeys[data.ProductKey] {
+		return false
+	}
+	return true
+}
+
+// Events returns the events of the message routed by routingKey that
+// belong to the handler, as maps for the messages of a batch.
+func (f *filter) Events(routingKey string, data *Output) []interface{} {
+	var events []interface{}
+	for _, event := range data.events() {
+		if f.Match(routingKey, event) {
+			events = append(events, event.ToMap())
+		}
+	}
+	return events
+}
+
+// matchTopic matches the words of a routing key against a topic pattern,
+// where * matches exactly one word and # zero or more words.
+func matchTopic(pattern, key []string) bool {
+	if len(pattern) == 0 {
+		return len(key) == 0
+	}
+	switch pattern[0] {
+	case "#":
+		for i := 0; i <= len(key); i++ {
+			if matchTopic(pattern[1:], key[i:]) {
+				return true
+			}
+		}
+		return false
+	case "*":
+		return len(key) > 0 && matchTopic(pattern[1:], key[1:])
+	default:
+		return len(key) > 0 && key[0] == pattern[0] && matchTopic(pattern[1:], key[1:])
+	}
+}
+
+func splitSet(s string) map[string]bool {
+	if s == "" {
+		return nil
+	}
+	set := make(map[string]bool)
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			set[v] = true
+		}
+	}
+	return set
+}
@@ -0,0 +1,43 @@
+package rabbitmq
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMatchTopic(t *testing.T) {
+	cases := []struct {
+		pattern, key string
+		match        bool
+	}{
+		{"gizwits.device_status_kv", "gizwits.device_status_kv", true},
+		{"gizwits.device_status_kv", "gizwits.device_online", false},
+		{"gizwits.*", "gizwits.device_online", true},
+		{"gizwits.*", "gizwits", false},
+		{"gizwits.*", "gizwits.pk.device_online", false},
+		{"gizwits.#", "gizwits", true},
+		{"gizwits.#", "gizwits.pk.device_online", true},
+		{"#.device_online", "gizwits.pk.device_online", true},
+		{"#.device_online", "device_online", true},
+		{"*.*.device_online", "gizwits.pk.device_online", true},
+		{"#", "", true},
+		{"#.*.#", "gizwits", true},
+		{"*.#", "gizwits.pk", true},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.match, matchTopic(strings.Split(c.pattern, "."), strings.Split(c.key, ".")), "%s %s", c.pattern, c.key)
+	}
+}
+
+func TestFilter_Match(t *testing.T) {
+	f := newFilter(&HandlerSettings{RoutingKey: "gizwits.#", EventType: "device_online, device_offline", ProductKey: "pk1"})
+	assert.True(t, f.Match("gizwits.pk1", &Output{EventType: "device_online", ProductKey: "pk1"}))
+	assert.False(t, f.Match("other.pk1", &Output{EventType: "device_online", ProductKey: "pk1"}))
+	assert.False(t, f.Match("gizwits.pk1", &Output{EventType: "device_status_kv", ProductKey: "pk1"}))
+	assert.False(t, f.Match("gizwits.pk2", &Output{EventType: "device_online", ProductKey: "pk2"}))
+
+	f = newFilter(&HandlerSettings{})
+	assert.True(t, f.Match("", &Output{}))
+}
@@ -3,9 +3,11 @@ module github.com/insrat/gf-plugins/trigger/rabbitmq
 go 1.21.0
 
 require (
+	github.com/insrat/gf-plugins/internal/amqpconn v0.0.0
 	github.com/project-flogo/core v1.6.7
 	github.com/streadway/amqp v1.1.0
 	github.com/stretchr/testify v1.8.4
+	google.golang.org/protobuf v1.34.2
 )
 
 require (
@@ -19,7 +21,10 @@ require (
 	golang.org/x/lint v0.0.0-20210508222113-6edffad5e616 // indirect
 	golang.org/x/sys v0.0.0-20220412211240-33da011f77ad // indirect
 	golang.org/x/tools v0.1.2 // indirect
+	golang.org/x/xerrors v0.0.0-20200804184101-5ec99f83aff1 // indirect
 	gopkg.in/yaml.v2 v2.4.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 	honnef.co/go/tools v0.0.1-2020.1.4 // indirect
 )
+
+replace github.com/insrat/gf-plugins/internal/amqpconn => ../../internal/amqpconn
@@ -5,12 +5,72 @@ import (
 )
 
 type Settings struct {
-	BrokerUrl     string `md:"brokerUrl,required"`
-	ExchangeName  string `md:"exchangeName,required"`
-	QueueName     string `md:"queueName,required"`
-	RoutingKeys   string `md:"routingKeys,required"`
+	BrokerUrl    string `md:"brokerUrl,required"`
+	ExchangeName string `md:"exchangeName,required"`
+	QueueName    string `md:"queueName,required"`
+	// RoutingKeys are bound in addition to the routing keys of the handlers.
+	RoutingKeys   string `md:"routingKeys"`
 	PrefetchCount int64  `md:"prefetchCount,required"`
 	NoAck         bool   `md:"noAck,required"`
+	// DeadLetterExchange receives rejected messages, routed by the queue name
+	// to the queue <queueName>.dead.
+	DeadLetterExchange string `md:"deadLetterExchange"`
+	// MaxRedeliveries dead-letters messages failing more often, 0 retries forever.
+	MaxRedeliveries int64 `md:"maxRedeliveries"`
+	// RetryDelay holds failed messages in the queue <queueName>.retry, e.g. 30s.
+	RetryDelay string `md:"retryDelay"`
+	// ExchangeType declares the exchange, which is expected to exist when empty.
+	ExchangeType    string `md:"exchangeType"`
+	ExchangeDurable bool   `md:"exchangeDurable"`
+	// QueueType is one of classic (default), quorum or stream.
+	QueueType string `md:"queueType"`
+	// QueueArguments are extra queue arguments, e.g. x-message-ttl,
+	// x-max-length, x-overflow or x-single-active-consumer.
+	QueueArguments map[string]interface{} `md:"queueArguments"`
+	// PassiveDeclare only checks that the queue exists, for queues managed elsewhere.
+	PassiveDeclare bool   `md:"passiveDeclare"`
+	ConsumerTag    string `md:"consumerTag"`
+	// CACertFile, ClientCertFile and ClientKeyFile are PEM files for amqps.
+	CACertFile     string `md:"caCertFile"`
+	ClientCertFile string `md:"clientCertFile"`
+	ClientKeyFile  string `md:"clientKeyFile"`
+	ServerName     string `md:"serverName"`
+	// SASLExternal authenticates with the client certificate instead of a password.
+	SASLExternal bool `md:"saslExternal"`
+	// PasswordFile and PasswordEnv replace the password of the broker URL.
+	PasswordFile   string `md:"passwordFile"`
+	PasswordEnv    string `md:"passwordEnv"`
+	ConnectionName string `md:"connectionName"`
+	// Decoder is one of json (default), cloudevents, protobuf, raw or auto,
+	// which picks the decoder by the content type, json without one.
+	Decoder string `md:"decoder"`
+	// ProtoDescriptorSet is a FileDescriptorSet file holding ProtoMessage,
+	// the fully qualified name of the messages.
+	ProtoDescriptorSet string `md:"protoDescriptorSet"`
+	ProtoMessage       string `md:"protoMessage"`
+	// MaxDecompressedSize bounds a gzip body once decompressed, in bytes,
+	// defaults to 16 MiB.
+	MaxDecompressedSize int64 `md:"maxDecompressedSize"`
+	// DrainTimeout bounds how long Stop waits for in-flight messages, e.g. 30s.
+	DrainTimeout string `md:"drainTimeout"`
+	// Concurrency is the number of workers, defaults to GOMAXPROCS.
+	Concurrency int `md:"concurrency"`
+	// OrderedByDevice hands the messages of a device, by product key and
+	// MAC, to the same worker so that they are handled in order.
+	OrderedByDevice bool `md:"orderedByDevice"`
+	// BatchSize above 1 hands up to that many messages to the handlers at
+	// once as the messages output, BatchTimeout bounds how long a batch
+	// waits to fill up, e.g. 100ms.
+	BatchSize    int    `md:"batchSize"`
+	BatchTimeout string `md:"batchTimeout"`
+}
+
+type HandlerSettings struct {
+	// RoutingKey is a topic pattern, where * matches one word and # any words.
+	RoutingKey string `md:"routingKey"`
+	// EventType and ProductKey are comma-separated lists.
+	EventType  string `md:"eventType"`
+	ProductKey string `md:"productKey"`
 }
 
 type Output struct {
@@ -20,6 +80,12 @@ type Output struct {
 	EventType  string                 `md:"eventType" json:"event_type"`
 	EventData  map[string]interface{} `md:"eventData" json:"data"`
 	EventTime  float64                `md:"eventTime" json:"created_at"`
+	// RawBody is the decompressed body, Headers are the AMQP headers.
+	RawBody []byte                 `md:"rawBody" json:"-"`
+	Headers map[string]interface{} `md:"headers" json:"-"`
+	// Messages holds the outputs of a batch in batch mode. Decoded JSON
+	// array messages keep their events here until they are dispatched.
+	Messages []interface{} `md:"messages" json:"-"`
 }
 
 // FromMap converts the values from a map into the struct Output
@@ -45,6 +111,18 @@ func (o *Output) FromMap(values map[string]interface{}) (err error) {
 		return
 	}
 	o.EventTime, err = coerce.ToFloat64(values["eventTime"])
+	if err != nil {
+		return
+	}
+	o.RawBody, err = coerce.ToBytes(values["rawBody"])
+	if err != nil {
+		return
+	}
+	o.Headers, err = coerce.ToObject(values["headers"])
+	if err != nil {
+		return
+	}
+	o.Messages, err = coerce.ToArray(values["messages"])
 	return
 }
 
@@ -57,5 +135,8 @@ func (o *Output) ToMap() map[string]interface{} {
 		"eventType":  o.EventType,
 		"eventData":  o.EventData,
 		"eventTime":  o.EventTime,
+		"rawBody":    o.RawBody,
+		"headers":    o.Headers,
+		"messages":   o.Messages,
 	}
 }
@@ -0,0 +1,55 @@
+package rabbitmq
+
+import (
+	"hash/fnv"
+
+	"github.com/streadway/amqp"
+)
+
+// workerQueueSize buffers the messages of a worker in ordered mode, so that
+// one busy device does not hold back the others right away.
+const workerQueueSize = 16
+
+// message is a delivery decoded for the workers.
+type message struct {
+	delivery amqp.Delivery
+	data     *Output
+	err      error
+}
+
+// newQueues returns the queues of the workers: one shared queue, or one
+// queue per worker when messages are ordered by device. The single worker
+// of batch mode keeps the order of all messages.
+func newQueues(s *Settings) []chan message {
+	if !s.OrderedByDevice || s.BatchSize > 1 {
+		return []chan message{make(chan message)}
+	}
+	queues := make([]chan message, s.Concurrency)
+	for i := range queues {
+		queues[i] = make(chan message, workerQueueSize)
+	}
+	return queues
+}
+
+func (t *Trigger) decode(d amqp.Delivery) message {
+	data, err := t.decoders.Decode(d)
+	return message{delivery: d, data: data, err: err}
+}
+
+// queue returns the queue of the worker handling the message. Undecodable
+// messages carry no device and go to the first worker.
+func (t *Trigger) queue(m message) chan message {
+	if len(t.queues) == 1 || m.data == nil {
+		return t.queues[0]
+	}
+	return t.queues[deviceWorker(m.data.ProductKey, m.data.DeviceMac, len(t.queues))]
+}
+
+// deviceWorker hashes a device to one of n workers.
+func deviceWorker(productKey, mac string, n int) int {
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(productKey))
+	_, _ = h.Write([]byte{0})
+	_, _ = h.Write([]byte(mac))
+	return int(h.Sum32() % uint32(n))
+}
@@ -0,0 +1,47 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceWorker(t *testing.T) {
+	used := make(map[int]bool)
+	for i := 0; i < 100; i++ {
+		worker := deviceWorker("pk", fmt.Sprintf("mac%d", i), 4)
+		assert.Equal(t, worker, deviceWorker("pk", fmt.Sprintf("mac%d", i), 4))
+		assert.True(t, worker >= 0 && worker < 4)
+		used[worker] = true
+	}
+	assert.Len(t, used, 4)
+	assert.Equal(t, 0, deviceWorker("pk", "mac", 1))
+}
+
+func TestTrigger_OrderedByDevice(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", Concurrency: 4, OrderedByDevice: true}, broker, handler)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+	assert.Len(t, trg.queues, 4)
+
+	channel := broker.Channel(t, 0)
+	for i := 0; i < 10; i++ {
+		for _, mac := range []string{"m1", "m2", "m3"} {
+			channel.Deliver(fmt.Sprintf(`{"product_key":"pk","mac":%q,"data":{"seq":%d}}`, mac, i))
+		}
+	}
+	assert.Eventually(t, func() bool { return handler.Count() == 30 }, time.Second, time.Millisecond)
+
+	next := make(map[string]float64)
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	for _, data := range handler.data {
+		out := data.(*Output)
+		assert.Equal(t, next[out.DeviceMac], out.EventData["seq"], "device %s", out.DeviceMac)
+		next[out.DeviceMac]++
+	}
+}
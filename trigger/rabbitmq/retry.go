@@ -0,0 +1,131 @@
+package rabbitmq
+
+import (
+	"github.com/streadway/amqp"
+)
+
+// redeliveryHeader counts how many times a failed message was published
+// again, requeued messages carry no count of their own.
+const redeliveryHeader = "x-redelivery-count"
+
+// originalRoutingKeyHeader keeps the routing key of a published again
+// message, which comes back routed by the queue name.
+const originalRoutingKeyHeader = "x-original-routing-key"
+
+// declareRetry sets up the dead-letter exchange with its queue and the
+// retry queue, which holds failed messages for the retry delay and then
+// dead-letters them back to the consumption queue.
+func (t *Trigger) declareRetry(channel AMQPChannel) error {
+	if dlx := t.settings.DeadLetterExchange; dlx != "" {
+		if err := channel.ExchangeDeclare(dlx, amqp.ExchangeDirect, true, false, false, false, nil); err != nil {
+			return err
+		}
+		if _, err := channel.QueueDeclare(t.deadQueue(), true, false, false, false, nil); err != nil {
+			return err
+		}
+		if err := channel.QueueBind(t.deadQueue(), t.settings.QueueName, dlx, false, nil); err != nil {
+			return err
+		}
+	}
+	if t.retryDelay > 0 {
+		if _, err := channel.QueueDeclare(t.retryQueue(), true, false, false, false, amqp.Table{
+			"x-message-ttl":             t.retryDelay.Milliseconds(),
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": t.settings.QueueName,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t *Trigger) deadQueue() string {
+	return t.settings.QueueName + ".dead"
+}
+
+func (t *Trigger) retryQueue() string {
+	return t.settings.QueueName + ".retry"
+}
+
+// retry publishes a failed message again, through the retry queue when
+// there is a retry delay, and dead-letters it once it has been redelivered
+// MaxRedeliveries times. Without either setting the message is requeued.
+// The redelivered message runs every matching handler again, including
+// those that succeeded before, so handlers have to be idempotent.
+func (t *Trigger) retry(d amqp.Delivery) {
+	if t.settings.MaxRedeliveries <= 0 && t.retryDelay <= 0 {
+		_ = d.Nack(false, true)
+		return
+	}
+	count := redeliveries(d.Headers) + 1
+	if t.settings.MaxRedeliveries > 0 && count > t.settings.MaxRedeliveries {
+		t.deadLetter(d, "too many redeliveries")
+		return
+	}
+
+	channel := t.conn.Channel()
+	if channel == nil {
+		_ = d.Nack(false, true)
+		return
+	}
+	key := t.settings.QueueName
+	if t.retryDelay > 0 {
+		key = t.retryQueue()
+	}
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers[redeliveryHeader] = count
+	headers[originalRoutingKeyHeader] = routingKey(d)
+	if err := channel.Publish("", key, false, false, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}); err != nil {
+		t.logger.Errorf("failed to publish message for redelivery, requeue it: %v", err)
+		_ = d.Nack(false, true)
+		return
+	}
+	_ = d.Ack(false)
+}
+
+// deadLetter rejects the message, the queue routes it to the dead-letter
+// exchange if there is one.
+func (t *Trigger) deadLetter(d amqp.Delivery, reason string) {
+	if t.settings.DeadLetterExchange == "" {
+		t.logger.Errorf("drop message %s: %s", d.MessageId, reason)
+	} else {
+		t.logger.Warnf("dead-letter message %s: %s", d.MessageId, reason)
+	}
+	_ = d.Nack(false, false)
+}
+
+// routingKey returns the routing key the message was first published with.
+func routingKey(d amqp.Delivery) string {
+	if key, ok := d.Headers[originalRoutingKeyHeader].(string); ok {
+		return key
+	}
+	return d.RoutingKey
+}
+
+func redeliveries(headers amqp.Table) int64 {
+	switch v := headers[redeliveryHeader].(type) {
+	case int64:
+		return v
+	case int32:
+		return int64(v)
+	case int:
+		return int64(v)
+	}
+	return 0
+}
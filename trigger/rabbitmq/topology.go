@@ -0,0 +1,105 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/streadway/amqp"
+)
+
+var queueTypes = map[string]bool{"": true, "classic": true, "quorum": true, "stream": true}
+
+// declare sets up the exchange, queues and bindings the trigger consumes.
+// A passively declared queue has to exist already, its arguments are left
+// to whoever manages it.
+func (t *Trigger) declare(channel AMQPChannel) error {
+	if t.settings.ExchangeType != "" {
+		if err := channel.ExchangeDeclare(
+			t.settings.ExchangeName,
+			t.settings.ExchangeType,
+			t.settings.ExchangeDurable,
+			false,
+			false,
+			false,
+			nil,
+		); err != nil {
+			return err
+		}
+	}
+
+	if err := t.declareRetry(channel); err != nil {
+		return err
+	}
+
+	// Set up consumption queue.
+	if t.settings.PassiveDeclare {
+		if _, err := channel.QueueDeclarePassive(t.settings.QueueName, true, false, false, false, nil); err != nil {
+			return err
+		}
+	} else if _, err := channel.QueueDeclare(
+		t.settings.QueueName, // 队列名
+		true,                 // 持久性
+		false,                // 删除时没有消费者时自动删除队列
+		false,                // 独占队列
+		false,                // 不等待服务器响应
+		t.queueArguments(),
+	); err != nil {
+		return err
+	}
+
+	// Bind consumption routing to queue.
+	for _, routingKey := range t.routingKeys() {
+		if err := channel.QueueBind(
+			t.settings.QueueName,    // 队列名
+			routingKey,              // 路由键值
+			t.settings.ExchangeName, // 交换机名
+			false,
+			nil,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queueArguments returns the arguments of the consumption queue. With a
+// dead-letter exchange, rejected messages are routed by the queue name so
+// that one exchange can serve several queues.
+func (t *Trigger) queueArguments() amqp.Table {
+	args := toTable(t.settings.QueueArguments)
+	if t.settings.QueueType != "" {
+		args["x-queue-type"] = t.settings.QueueType
+	}
+	if t.settings.DeadLetterExchange != "" {
+		args["x-dead-letter-exchange"] = t.settings.DeadLetterExchange
+		args["x-dead-letter-routing-key"] = t.settings.QueueName
+	}
+	if len(args) == 0 {
+		return nil
+	}
+	return args
+}
+
+// toTable converts settings to AMQP arguments. JSON numbers arrive as
+// float64, which the broker refuses for integer arguments such as
+// x-message-ttl, so whole numbers are sent as integers.
+func toTable(values map[string]interface{}) amqp.Table {
+	table := amqp.Table{}
+	for k, v := range values {
+		if f, ok := v.(float64); ok && f == math.Trunc(f) && math.Abs(f) < math.MaxInt64 {
+			v = int64(f)
+		}
+		table[k] = v
+	}
+	return table
+}
+
+func validateTopology(s *Settings) error {
+	if !queueTypes[s.QueueType] {
+		return fmt.Errorf("unsupported queue type %s", s.QueueType)
+	}
+	if s.ExchangeType != "" && s.ExchangeName == "" {
+		return fmt.Errorf("the default exchange cannot be declared")
+	}
+	return toTable(s.QueueArguments).Validate()
+}
@@ -0,0 +1,45 @@
+package rabbitmq
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTrigger_Declare(t *testing.T) {
+	broker := &fakeBroker{}
+	trg := newFakeTrigger(&Settings{
+		ExchangeName:    "gizwits",
+		ExchangeType:    "topic",
+		ExchangeDurable: true,
+		QueueName:       "scene",
+		QueueType:       "quorum",
+		QueueArguments:  map[string]interface{}{"x-message-ttl": float64(60000), "x-overflow": "reject-publish"},
+		RoutingKeys:     "gizwits.#",
+		ConsumerTag:     "scene-1",
+	}, broker)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+	assert.Equal(t, []string{
+		"dial",
+		"qos",
+		"exchange gizwits topic",
+		"declare scene map[x-message-ttl:60000 x-overflow:reject-publish x-queue-type:quorum]",
+		"bind scene gizwits.# gizwits",
+		"consume scene",
+	}, broker.Calls())
+	assert.IsType(t, int64(0), trg.queueArguments()["x-message-ttl"])
+
+	broker = &fakeBroker{}
+	trg = newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", PassiveDeclare: true}, broker)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+	assert.Equal(t, []string{"dial", "qos", "check scene", "consume scene"}, broker.Calls())
+}
+
+func TestValidateTopology(t *testing.T) {
+	assert.Nil(t, validateTopology(&Settings{ExchangeName: "gizwits", ExchangeType: "topic", QueueType: "stream"}))
+	assert.NotNil(t, validateTopology(&Settings{QueueType: "lazy"}))
+	assert.NotNil(t, validateTopology(&Settings{ExchangeType: "topic"}))
+	assert.NotNil(t, validateTopology(&Settings{QueueArguments: map[string]interface{}{"x-max-length": []string{"1"}}}))
+}
@@ -2,21 +2,31 @@ package rabbitmq
 
 import (
 	"context"
-	"encoding/json"
+	"fmt"
 	"runtime"
+	"strings"
+	"sync"
+	"time"
 
+	"github.com/insrat/gf-plugins/internal/amqpconn"
 	"github.com/project-flogo/core/data/metadata"
 	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/trigger"
 	"github.com/streadway/amqp"
 )
 
-var triggerMd = trigger.NewMetadata(&Settings{}, &Output{})
+var triggerMd = trigger.NewMetadata(&Settings{}, &HandlerSettings{}, &Output{})
 
 func init() {
 	_ = trigger.Register(&Trigger{}, &Factory{})
 }
 
+const (
+	defaultConsumerTag  = "flogo-scene"
+	defaultDrainTimeout = 30 * time.Second
+	defaultBatchTimeout = 100 * time.Millisecond
+)
+
 // Factory is a trigger factory
 type Factory struct {
 }
@@ -34,69 +44,260 @@ func (*Factory) New(config *trigger.Config) (trigger.Trigger, error) {
 		return nil, err
 	}
 
-	return &Trigger{settings: s}, nil
+	if err = validateTopology(s); err != nil {
+		return nil, err
+	}
+	if s.Concurrency <= 0 {
+		s.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if s.ConsumerTag == "" {
+		s.ConsumerTag = defaultConsumerTag
+	}
+	var retryDelay time.Duration
+	if s.RetryDelay != "" {
+		if retryDelay, err = time.ParseDuration(s.RetryDelay); err != nil {
+			return nil, err
+		}
+	}
+
+	dial, err := amqpconn.DialAMQP(s.BrokerUrl, amqpconn.DialOptions{
+		CACertFile:     s.CACertFile,
+		ClientCertFile: s.ClientCertFile,
+		ClientKeyFile:  s.ClientKeyFile,
+		ServerName:     s.ServerName,
+		SASLExternal:   s.SASLExternal,
+		PasswordFile:   s.PasswordFile,
+		PasswordEnv:    s.PasswordEnv,
+		ConnectionName: s.ConnectionName,
+		Product:        "flogo-rabbitmq",
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	decoders, err := newDecoders(s)
+	if err != nil {
+		return nil, err
+	}
+	drain := defaultDrainTimeout
+	if s.DrainTimeout != "" {
+		if drain, err = time.ParseDuration(s.DrainTimeout); err != nil {
+			return nil, err
+		}
+	}
+
+	batchTimeout := defaultBatchTimeout
+	if s.BatchTimeout != "" {
+		if batchTimeout, err = time.ParseDuration(s.BatchTimeout); err != nil {
+			return nil, err
+		}
+	}
+	if s.BatchSize > 1 && !s.NoAck && s.PrefetchCount > 0 && s.PrefetchCount < int64(s.BatchSize) {
+		return nil, fmt.Errorf("prefetch count %d is smaller than the batch size %d", s.PrefetchCount, s.BatchSize)
+	}
+
+	return &Trigger{
+		settings:     s,
+		dial:         dialer(dial),
+		decoders:     decoders,
+		retryDelay:   retryDelay,
+		drain:        drain,
+		batchTimeout: batchTimeout,
+	}, nil
 }
 
 // Trigger is a kafka trigger
 type Trigger struct {
-	settings *Settings
-	conn     *Connection
-	shutdown chan struct{}
-	handlers []trigger.Handler
-	logger   log.Logger
+	settings     *Settings
+	dial         amqpconn.Dialer[AMQPChannel]
+	decoders     *decoders
+	retryDelay   time.Duration
+	drain        time.Duration
+	batchTimeout time.Duration
+	conn         *amqpconn.Connection[AMQPChannel]
+	queues       []chan message
+	shutdown     chan struct{}
+	workers      sync.WaitGroup
+	handlers     []*handler
+	logger       log.Logger
 }
 
 // Initialize initializes the trigger
 func (t *Trigger) Initialize(ctx trigger.InitContext) (err error) {
-	t.handlers = ctx.GetHandlers()
-	t.logger = ctx.Logger()
-	t.conn, err = getRabbitMQConnection(t.logger, t.settings)
+	return t.initialize(ctx.GetHandlers(), ctx.Logger())
+}
+
+func (t *Trigger) initialize(handlers []trigger.Handler, logger log.Logger) (err error) {
+	if t.handlers, err = newHandlers(handlers); err != nil {
+		return
+	}
+	t.logger = logger
+	t.queues = newQueues(t.settings)
+	t.shutdown = make(chan struct{})
+	t.conn = amqpconn.NewConnection(t.logger, t.dial, t.consume)
 	return
 }
 
 // Start starts the kafka trigger
 func (t *Trigger) Start() error {
-	deliveries, err := t.conn.Connection()
-	if err != nil {
+	if err := t.conn.Start(); err != nil {
 		return err
 	}
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go t.handleMessage(deliveries)
+	if t.settings.BatchSize > 1 {
+		t.workers.Add(1)
+		go t.handleBatches(t.queues[0])
+		return nil
+	}
+	for i := 0; i < t.settings.Concurrency; i++ {
+		t.workers.Add(1)
+		go t.handleMessage(t.queues[i%len(t.queues)])
 	}
 	return nil
 }
 
-// Stop implements ext.Trigger.Stop
+// Stop implements ext.Trigger.Stop. It cancels the consumer, requeues the
+// messages no worker has taken yet and gives the in-flight ones the drain
+// timeout to finish before the connection closes.
 func (t *Trigger) Stop() error {
 	t.conn.Stop()
+	if channel := t.conn.Channel(); channel != nil {
+		if err := channel.Cancel(t.settings.ConsumerTag, false); err != nil {
+			t.logger.Errorf("failed to cancel consumer %s : %v", t.settings.ConsumerTag, err)
+		}
+	}
+	close(t.shutdown)
+
+	drained := make(chan struct{})
+	go func() {
+		t.workers.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(t.drain):
+		t.logger.Warnf("in-flight messages did not finish within %v, they will be redelivered", t.drain)
+	}
+	t.conn.Close()
 	return nil
 }
 
-func (t *Trigger) handleMessage(deliveries <-chan amqp.Delivery) {
-	var err error
-	for d := range deliveries {
-		data := &Output{}
-		if err = json.Unmarshal(d.Body, data); err != nil {
-			if !t.settings.NoAck {
-				_ = d.Ack(false)
+// consume sets up a fresh channel and forwards its deliveries to the
+// workers, which keep reading from the same channel across reconnects.
+func (t *Trigger) consume(channel AMQPChannel) error {
+	// Set channel prefetch count.
+	if err := channel.Qos(int(t.settings.PrefetchCount), 0, false); err != nil {
+		return err
+	}
+
+	if err := t.declare(channel); err != nil {
+		return err
+	}
+
+	deliveries, err := channel.Consume(
+		t.settings.QueueName,
+		t.settings.ConsumerTag, // 消费者标识
+		t.settings.NoAck,       // 显式确认
+		false,                  // 不独占
+		false,                  // 不等待服务器响应
+		false,                  // 不阻塞
+		nil,
+	)
+	if err != nil {
+		return err
+	}
+	// The deliveries close with their channel or consumer.
+	go func() {
+		for d := range deliveries {
+			m := t.decode(d)
+			select {
+			case t.queue(m) <- m:
+			case <-t.shutdown:
+				t.requeue(d)
 			}
-			continue
 		}
+	}()
+	return nil
+}
 
-		for _, handler := range t.handlers {
-			if _, err = handler.Handle(context.Background(), data); err != nil {
-				t.logger.Errorf("run action for handler [%s] failed for reason [%s] message lost", handler.Name(), err)
-				break
+// requeue returns a message no worker took before shutdown.
+func (t *Trigger) requeue(d amqp.Delivery) {
+	if !t.settings.NoAck {
+		_ = d.Nack(false, true)
+	}
+}
+
+// routingKeys returns the routing keys of the trigger and its handlers.
+func (t *Trigger) routingKeys() []string {
+	var routingKeys []string
+	seen := make(map[string]bool)
+	add := func(routingKey string) {
+		if routingKey = strings.TrimSpace(routingKey); routingKey != "" && !seen[routingKey] {
+			seen[routingKey] = true
+			routingKeys = append(routingKeys, routingKey)
+		}
+	}
+	for _, routingKey := range strings.Split(t.settings.RoutingKeys, ",") {
+		add(routingKey)
+	}
+	for _, handler := range t.handlers {
+		add(strings.Join(handler.filter.routingKey, "."))
+	}
+	return routingKeys
+}
+
+func (t *Trigger) handleMessage(queue chan message) {
+	defer t.workers.Done()
+	for {
+		select {
+		case <-t.shutdown:
+			// Requeue what is still waiting for this worker.
+			for {
+				select {
+				case m := <-queue:
+					t.requeue(m.delivery)
+				default:
+					return
+				}
 			}
+		case m := <-queue:
+			t.handle(m)
 		}
+	}
+}
 
-		if t.settings.NoAck {
+func (t *Trigger) handle(m message) {
+	d, data, err := m.delivery, m.data, m.err
+	if err != nil {
+		if !t.settings.NoAck {
+			t.deadLetter(d, fmt.Sprintf("invalid message: %v", err))
+		}
+		return
+	}
+
+	for _, handler := range t.handlers {
+		out := data
+		if data.Messages != nil {
+			// An array message runs the handler once with its events.
+			messages := handler.filter.Events(routingKey(d), data)
+			if len(messages) == 0 {
+				continue
+			}
+			out = &Output{RawBody: data.RawBody, Headers: data.Headers, Messages: messages}
+		} else if !handler.filter.Match(routingKey(d), data) {
 			continue
 		}
-		if err == nil {
-			_ = d.Ack(false)
-		} else {
-			_ = d.Nack(false, true)
+		if _, err = handler.Handle(context.Background(), out); err != nil {
+			t.logger.Errorf("run action for handler [%s] failed for reason [%s] message lost", handler.Name(), err)
+			break
 		}
 	}
+
+	if t.settings.NoAck {
+		return
+	}
+	if err == nil {
+		_ = d.Ack(false)
+	} else {
+		t.retry(d)
+	}
 }
@@ -1,12 +1,22 @@
 package rabbitmq
 
 import (
+	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
+	"errors"
+	"runtime"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/insrat/gf-plugins/internal/amqpconn"
 	"github.com/project-flogo/core/action"
+	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/support/test"
 	"github.com/project-flogo/core/trigger"
+	"github.com/streadway/amqp"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -44,3 +54,238 @@ func TestSNotiTrigger_Initialize(t *testing.T) {
 	assert.Nil(t, err)
 
 }
+
+// fakeHandler records the data of every call and fails while err is set.
+// Calls wait for release if it is set.
+type fakeHandler struct {
+	mu      sync.Mutex
+	data    []interface{}
+	err     error
+	release chan struct{}
+}
+
+func (h *fakeHandler) Name() string                     { return "fake" }
+func (h *fakeHandler) Logger() log.Logger               { return log.RootLogger() }
+func (h *fakeHandler) Settings() map[string]interface{} { return nil }
+func (h *fakeHandler) Schemas() *trigger.SchemaConfig   { return nil }
+func (h *fakeHandler) Handle(ctx context.Context, triggerData interface{}) (map[string]interface{}, error) {
+	h.mu.Lock()
+	h.data = append(h.data, triggerData)
+	h.mu.Unlock()
+	if h.release != nil {
+		<-h.release
+	}
+	return nil, h.err
+}
+
+func (h *fakeHandler) Count() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.data)
+}
+
+func newFakeTrigger(settings *Settings, broker *fakeBroker, handlers ...trigger.Handler) *Trigger {
+	if settings.Concurrency == 0 {
+		settings.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	t := &Trigger{settings: settings, dial: broker.dial}
+	t.decoders, _ = newDecoders(settings)
+	t.drain = time.Second
+	_ = t.initialize(handlers, log.RootLogger())
+	return t
+}
+
+func TestTrigger_Reconnect(t *testing.T) {
+	amqpconn.MinReconnectDelay, amqpconn.MaxReconnectDelay = time.Millisecond, time.Millisecond
+	broker := &fakeBroker{}
+	handler := &fakeHandler{}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", RoutingKeys: "a.*,b.#", PrefetchCount: 10}, broker, handler)
+	assert.Nil(t, trg.Start())
+
+	broker.Channel(t, 0).Deliver(`{"product_key":"pk","mac":"m1","event_type":"device_online"}`)
+	assert.Eventually(t, func() bool { return handler.Count() == 1 }, time.Second, time.Millisecond)
+
+	broker.conns[0].shutdown(&amqp.Error{Code: amqp.ConnectionForced, Reason: "broker restart"})
+	broker.Channel(t, 1).Deliver(`{"product_key":"pk","mac":"m1","event_type":"device_offline"}`)
+	assert.Eventually(t, func() bool { return handler.Count() == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, "device_offline", handler.data[1].(*Output).EventType)
+
+	topology := []string{"qos", "declare scene", "bind scene a.* gizwits", "bind scene b.# gizwits", "consume scene"}
+	assert.Equal(t, append(append([]string{"dial"}, topology...), append([]string{"dial"}, topology...)...), broker.Calls())
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack", "ack"}, broker.Acks())
+
+	assert.Nil(t, trg.Stop())
+}
+
+func TestTrigger_Redelivery(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{err: errors.New("flow failed")}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", RoutingKeys: "#", DeadLetterExchange: "scene.dlx", MaxRedeliveries: 2}, broker, handler)
+	trg.retryDelay = 30 * time.Second
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+
+	assert.Equal(t, []string{
+		"dial",
+		"qos",
+		"exchange scene.dlx direct",
+		"declare scene.dead",
+		"bind scene.dead scene scene.dlx",
+		"declare scene.retry map[x-dead-letter-exchange: x-dead-letter-routing-key:scene x-message-ttl:30000]",
+		"declare scene map[x-dead-letter-exchange:scene.dlx x-dead-letter-routing-key:scene]",
+		"bind scene # gizwits",
+		"consume scene",
+	}, broker.Calls())
+
+	channel := broker.Channel(t, 0)
+	channel.Deliver(`{"event_type":"device_online"}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, `publish "" scene.retry 1`, broker.Calls()[9])
+	assert.Equal(t, []string{"ack"}, broker.Acks())
+
+	// The retry queue sends it back with the count of redeliveries so far.
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, Body: []byte(`{}`), Headers: amqp.Table{redeliveryHeader: int64(2)}}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack", "nack"}, broker.Acks())
+	assert.Len(t, broker.Calls(), 10)
+
+	// Invalid messages are dead-lettered without running the handlers.
+	channel.Deliver(`{"event_type"`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack", "nack", "nack"}, broker.Acks())
+	assert.Equal(t, 2, handler.Count())
+}
+
+func TestTrigger_RedeliveryFiltered(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &filteredHandler{fakeHandler: &fakeHandler{err: errors.New("flow failed")}, settings: map[string]interface{}{"routingKey": "device.*"}}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", MaxRedeliveries: 3}, broker, handler)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+
+	channel := broker.Channel(t, 0)
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, RoutingKey: "device.online", Body: []byte(`{}`)}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	published := broker.Published()
+	assert.Equal(t, "device.online", published[0].Headers[originalRoutingKeyHeader])
+
+	// Published again to the queue, it still matches by its original key.
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, RoutingKey: "scene", Body: published[0].Body, Headers: published[0].Headers}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, 2, handler.Count())
+	published = broker.Published()
+	assert.Equal(t, "device.online", published[1].Headers[originalRoutingKeyHeader])
+	assert.Equal(t, int64(2), published[1].Headers[redeliveryHeader])
+}
+
+func TestTrigger_Requeue(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{err: errors.New("flow failed")}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", RoutingKeys: "#"}, broker, handler)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+
+	broker.Channel(t, 0).Deliver(`{}`)
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"nack requeue"}, broker.Acks())
+}
+
+// filteredHandler is a fakeHandler with handler settings.
+type filteredHandler struct {
+	*fakeHandler
+	settings map[string]interface{}
+}
+
+func (h filteredHandler) Settings() map[string]interface{} { return h.settings }
+
+func TestTrigger_Dispatch(t *testing.T) {
+	broker := &fakeBroker{}
+	report, presence := &fakeHandler{}, &fakeHandler{}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene"}, broker,
+		filteredHandler{report, map[string]interface{}{"routingKey": "gizwits.*.kv", "eventType": "device_status_kv"}},
+		filteredHandler{presence, map[string]interface{}{"routingKey": "gizwits.#", "eventType": "device_online,device_offline"}},
+	)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+	assert.Equal(t, []string{"bind scene gizwits.*.kv gizwits", "bind scene gizwits.# gizwits"}, broker.Calls()[3:5])
+
+	channel := broker.Channel(t, 0)
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, RoutingKey: "gizwits.pk.kv", Body: []byte(`{"event_type":"device_status_kv"}`)}
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, RoutingKey: "gizwits.pk.online", Body: []byte(`{"event_type":"device_online"}`)}
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, RoutingKey: "gizwits.pk.online", Body: []byte(`{"event_type":"device_bind"}`)}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 3 }, time.Second, time.Millisecond)
+	assert.Equal(t, 1, report.Count())
+	assert.Equal(t, 1, presence.Count())
+}
+
+func TestTrigger_DispatchArray(t *testing.T) {
+	broker := &fakeBroker{}
+	presence, report := &fakeHandler{}, &fakeHandler{}
+	trg := newFakeTrigger(&Settings{QueueName: "scene"}, broker,
+		filteredHandler{presence, map[string]interface{}{"eventType": "device_online,device_offline"}},
+		filteredHandler{report, map[string]interface{}{"eventType": "device_status_kv"}},
+	)
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+
+	var body bytes.Buffer
+	w := gzip.NewWriter(&body)
+	_, _ = w.Write([]byte(`[{"mac":"m1","event_type":"device_online"},{"mac":"m2","event_type":"device_bind"},{"mac":"m3","event_type":"device_offline"}]`))
+	assert.Nil(t, w.Close())
+	channel := broker.Channel(t, 0)
+	channel.deliveries <- amqp.Delivery{Acknowledger: channel, ContentEncoding: "gzip", Body: body.Bytes()}
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 1 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"ack"}, broker.Acks())
+	assert.Equal(t, 1, presence.Count())
+	messages := presence.data[0].(*Output).Messages
+	assert.Len(t, messages, 2)
+	assert.Equal(t, "m3", messages[1].(map[string]interface{})["deviceMac"])
+	assert.Equal(t, 0, report.Count())
+}
+
+func TestTrigger_Drain(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{release: make(chan struct{})}
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene", ConsumerTag: "scene-1"}, broker, handler)
+	assert.Nil(t, trg.Start())
+
+	// Keep every worker busy, with one message waiting in the forwarder
+	// and one prefetched.
+	workers := runtime.GOMAXPROCS(0)
+	channel := broker.Channel(t, 0)
+	for i := 0; i < workers+2; i++ {
+		channel.Deliver(`{}`)
+	}
+	assert.Eventually(t, func() bool { return handler.Count() == workers }, time.Second, time.Millisecond)
+
+	stopped := make(chan struct{})
+	go func() {
+		assert.Nil(t, trg.Stop())
+		close(stopped)
+	}()
+	assert.Eventually(t, func() bool { return len(broker.Acks()) == 2 }, time.Second, time.Millisecond)
+	assert.Equal(t, []string{"nack requeue", "nack requeue"}, broker.Acks())
+	assert.Contains(t, broker.Calls(), "cancel scene-1")
+	assert.False(t, broker.conns[0].closed)
+
+	close(handler.release)
+	<-stopped
+	assert.Len(t, broker.Acks(), workers+2)
+	assert.Equal(t, workers, handler.Count())
+	assert.True(t, broker.conns[0].closed)
+}
+
+func TestTrigger_DrainTimeout(t *testing.T) {
+	broker := &fakeBroker{}
+	handler := &fakeHandler{release: make(chan struct{})}
+	defer close(handler.release)
+	trg := newFakeTrigger(&Settings{ExchangeName: "gizwits", QueueName: "scene"}, broker, handler)
+	trg.drain = 10 * time.Millisecond
+	assert.Nil(t, trg.Start())
+
+	broker.Channel(t, 0).Deliver(`{}`)
+	assert.Eventually(t, func() bool { return handler.Count() == 1 }, time.Second, time.Millisecond)
+	assert.Nil(t, trg.Stop())
+	assert.True(t, broker.conns[0].closed)
+}
@@ -0,0 +1,26 @@
+package scenetick
+
+import (
+	"github.com/project-flogo/core/data/coerce"
+)
+
+type Settings struct {
+	Interval string `md:"interval"`
+}
+
+type Output struct {
+	TickTime int64 `md:"tickTime"`
+}
+
+// FromMap converts the values from a map into the struct Output
+func (o *Output) FromMap(values map[string]interface{}) (err error) {
+	o.TickTime, err = coerce.ToInt64(values["tickTime"])
+	return
+}
+
+// ToMap converts the struct Output into a map
+func (o *Output) ToMap() map[string]interface{} {
+	return map[string]interface{}{
+		"tickTime": o.TickTime,
+	}
+}
@@ -0,0 +1,110 @@
+package scenetick
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/project-flogo/core/data/metadata"
+	"github.com/project-flogo/core/support/log"
+	"github.com/project-flogo/core/trigger"
+)
+
+var triggerMd = trigger.NewMetadata(&Settings{}, &Output{})
+
+func init() {
+	_ = trigger.Register(&Trigger{}, &Factory{})
+}
+
+const defaultInterval = time.Minute
+
+// Factory is a trigger factory
+type Factory struct {
+}
+
+// Metadata implements trigger.Factory.Metadata
+func (*Factory) Metadata() *trigger.Metadata {
+	return triggerMd
+}
+
+// New implements trigger.Factory.New
+func (*Factory) New(config *trigger.Config) (trigger.Trigger, error) {
+	s := &Settings{}
+	err := metadata.MapToStruct(config.Settings, s, true)
+	if err != nil {
+		return nil, err
+	}
+
+	interval := defaultInterval
+	if s.Interval != "" {
+		if interval, err = time.ParseDuration(s.Interval); err != nil {
+			return nil, err
+		}
+		if interval < time.Second {
+			return nil, fmt.Errorf("interval %s is less than one second", s.Interval)
+		}
+	}
+
+	return &Trigger{settings: s, interval: interval}, nil
+}
+
+// Trigger is a timer trigger aligned to interval boundaries
+type Trigger struct {
+	settings *Settings
+	interval time.Duration
+	shutdown chan struct{}
+	handlers []trigger.Handler
+	logger   log.Logger
+}
+
+// Initialize initializes the trigger
+func (t *Trigger) Initialize(ctx trigger.InitContext) (err error) {
+	t.handlers = ctx.GetHandlers()
+	t.logger = ctx.Logger()
+	return
+}
+
+// Start starts the tick trigger
+func (t *Trigger) Start() error {
+	t.shutdown = make(chan struct{})
+	go t.run()
+	t.logger.Infof("start ticking every %s", t.interval)
+	return nil
+}
+
+// Stop implements ext.Trigger.Stop
+func (t *Trigger) Stop() error {
+	close(t.shutdown)
+	return nil
+}
+
+func (t *Trigger) run() {
+	for {
+		// The next tick is recalculated from the wall clock every time,
+		// so a slow handler or a late timer never accumulates drift.
+		tick := nextTick(time.Now(), t.interval)
+		timer := time.NewTimer(time.Until(tick))
+		select {
+		case <-t.shutdown:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		go t.handleTick(tick)
+	}
+}
+
+func (t *Trigger) handleTick(tick time.Time) {
+	data := &Output{TickTime: tick.Unix()}
+	for _, handler := range t.handlers {
+		if _, err := handler.Handle(context.Background(), data); err != nil {
+			t.logger.Errorf("run action for handler [%s] failed for reason [%s] at tick %s",
+				handler.Name(), err, tick.Format(time.DateTime))
+		}
+	}
+}
+
+// nextTick returns the first interval boundary strictly after now.
+func nextTick(now time.Time, interval time.Duration) time.Time {
+	return now.Truncate(interval).Add(interval)
+}
@@ -0,0 +1,51 @@
+package scenetick
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/project-flogo/core/action"
+	"github.com/project-flogo/core/support/test"
+	"github.com/project-flogo/core/trigger"
+	"github.com/stretchr/testify/assert"
+)
+
+const testConfig string = `{
+	"id": "flogo-scenetick",
+	"ref": "github.com/insrat/gf-plugins/trigger/scenetick",
+	"settings": {
+	  "interval": "1m"
+	},
+	"handlers": []
+  }`
+
+func TestSceneTickTrigger_Initialize(t *testing.T) {
+	f := &Factory{}
+
+	config := &trigger.Config{}
+	err := json.Unmarshal([]byte(testConfig), config)
+	assert.Nil(t, err)
+
+	actions := map[string]action.Action{"dummy": test.NewDummyAction(func() {
+		//do nothing
+	})}
+
+	trg, err := test.InitTrigger(f, config, actions)
+	assert.Nil(t, err)
+	assert.NotNil(t, trg)
+
+	err = trg.Start()
+	assert.Nil(t, err)
+	err = trg.Stop()
+	assert.Nil(t, err)
+}
+
+func TestNextTick(t *testing.T) {
+	now := time.Date(2024, 3, 1, 8, 30, 42, 500, time.UTC)
+
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 31, 0, 0, time.UTC), nextTick(now, time.Minute))
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 35, 0, 0, time.UTC), nextTick(now, 5*time.Minute))
+	// A tick exactly on the boundary schedules the following one.
+	assert.Equal(t, time.Date(2024, 3, 1, 8, 32, 0, 0, time.UTC), nextTick(time.Date(2024, 3, 1, 8, 31, 0, 0, time.UTC), time.Minute))
+}
@@ -1,10 +1,13 @@
 package snoti
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
 	"net"
 	"strings"
 	"time"
@@ -12,6 +15,9 @@ import (
 	"github.com/project-flogo/core/support/log"
 )
 
+// defaultMaxMessageSize bounds a message line unless the settings do.
+const defaultMaxMessageSize = 1 << 20
+
 type Connection interface {
 	Connect()
 	Close()
@@ -61,7 +67,12 @@ func (c *client) Connect() {
 		}
 		c.logger.Infof("handshake broker %s successfully", c.settings.BrokerUrl)
 
-		if err = c.login(); err != nil {
+		// Messages are newline-delimited, a read may return part of one or
+		// several at once. The reader lives as long as the connection so
+		// that no message following the login response is lost.
+		lines := newLineReader(c.tlsConn, c.settings.MaxMessageSize)
+
+		if err = c.login(lines); err != nil {
 			c.logger.Errorf("failed to login broker %s: %v", c.settings.BrokerUrl, err)
 			c.logger.Infof("reconnect broker %s after 15 seconds", c.settings.BrokerUrl)
 			time.Sleep(15 * time.Second)
@@ -70,7 +81,7 @@ func (c *client) Connect() {
 		c.logger.Infof("login broker %s successfully", c.settings.BrokerUrl)
 
 		ctx, cancel := context.WithCancel(context.Background())
-		go c.read(ctx)
+		go c.read(ctx, cancel, lines)
 		go c.write(ctx)
 		if isShutdown := c.ping(ctx, cancel); isShutdown {
 			return
@@ -100,27 +111,26 @@ func (c *client) Read() []byte {
 	}
 }
 
-func (c *client) read(ctx context.Context) {
+// read hands every message line to the receiving queue until the
+// connection breaks, which it reports by cancelling the context.
+func (c *client) read(ctx context.Context, cancel context.CancelFunc, lines *lineReader) {
+	defer cancel()
+	var err error
 	for {
-		select {
-		case <-ctx.Done():
-			c.logger.Warnf("the connection has been closed, exiting the reading thread")
-			return
-		default:
-		}
-		if err := c.tlsConn.SetReadDeadline(time.Now().Add(1 * time.Second)); err != nil {
-			c.logger.Errorf("failed to set read deadline: %v", err)
+		var buff []byte
+		if buff, err = lines.ReadLine(); err == errMessageTooLarge {
+			// The rest of the stream is intact, only this message is lost.
+			c.logger.Errorf("failed to read message: larger than %d bytes, message is lost", c.settings.MaxMessageSize)
 			continue
+		} else if err != nil {
+			break
 		}
-		buff := make([]byte, 1024)
-		n, err := c.tlsConn.Read(buff)
-		if err != nil || n == 0 {
+		if len(buff) == 0 {
 			continue
 		}
-		c.logger.Infof("read message successfully, the content is %s",
-			strings.Replace(string(buff[:n]), "\n", "", -1))
+		c.logger.Infof("read message successfully, the content is %s", string(buff))
 
-		resp := Decode(buff[:n])
+		resp := Decode(buff)
 		switch resp.Cmd {
 		case "pong":
 			c.heartbeat = time.Now()
@@ -132,16 +142,31 @@ func (c *client) read(ctx context.Context) {
 		}
 
 		select {
-		case c.receiveCh <- buff[:n]:
+		case c.receiveCh <- buff:
 		default:
 			lost := <-c.receiveCh
 			c.logger.Errorf("failed to read message: queue is full")
 			c.logger.Errorf("message is lost, the content is %s",
 				strings.Replace(string(lost), "\n", "", -1))
 
-			c.receiveCh <- buff[:n]
+			c.receiveCh <- buff
 		}
 	}
+
+	select {
+	case <-ctx.Done():
+		c.logger.Warnf("the connection has been closed, exiting the reading thread")
+		return
+	case <-c.shutdown:
+		c.logger.Warnf("the connection has been closed, exiting the reading thread")
+		return
+	default:
+	}
+	if err == io.EOF {
+		c.logger.Errorf("failed to read message: connection closed by broker")
+	} else {
+		c.logger.Errorf("failed to read message: %v", err)
+	}
 }
 
 func (c *client) Write(buff []byte) {
@@ -180,7 +205,7 @@ func (c *client) write(ctx context.Context) {
 	}
 }
 
-func (c *client) login() error {
+func (c *client) login(lines *lineReader) error {
 	req := LoginRequest{
 		Cmd:           "login_req",
 		PrefetchCount: 100,
@@ -198,14 +223,13 @@ func (c *client) login() error {
 		return err
 	}
 
-	buff := make([]byte, 1024)
-	n, err := c.tlsConn.Read(buff)
+	buff, err := lines.ReadLine()
 	if err != nil {
 		return err
 	}
 
 	var resp LoginResponse
-	if err = json.Unmarshal(buff[:n], &resp); err != nil {
+	if err = json.Unmarshal(buff, &resp); err != nil {
 		return err
 	}
 	if !resp.Data.Result {
@@ -236,3 +260,46 @@ func (c *client) ping(ctx context.Context, cancel context.CancelFunc) bool {
 		}
 	}
 }
+
+var errMessageTooLarge = errors.New("message too large")
+
+// lineReader splits the stream into newline-delimited messages. A message
+// over maxSize is discarded up to its newline, so that the messages after
+// it are still read.
+type lineReader struct {
+	r       *bufio.Reader
+	maxSize int
+}
+
+func newLineReader(r io.Reader, maxSize int) *lineReader {
+	return &lineReader{r: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadLine returns the next message without its line ending, or
+// errMessageTooLarge once an oversized one has been discarded.
+func (l *lineReader) ReadLine() ([]byte, error) {
+	var line []byte
+	tooLarge := false
+	for {
+		chunk, err := l.r.ReadSlice('\n')
+		if !tooLarge {
+			// Leave room for the line ending.
+			if len(line)+len(chunk) > l.maxSize+2 {
+				tooLarge, line = true, nil
+			} else {
+				line = append(line, chunk...)
+			}
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line = bytes.TrimRight(line, "\r\n")
+		if tooLarge || len(line) > l.maxSize {
+			return nil, errMessageTooLarge
+		}
+		return line, nil
+	}
+}
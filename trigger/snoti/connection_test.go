@@ -0,0 +1,169 @@
+package snoti
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/project-flogo/core/support/log"
+	"github.com/stretchr/testify/assert"
+)
+
+const loginResponse = `{"cmd":"login_res","data":{"result":true}}` + "\n"
+
+// fakeServer is a TLS broker with a self-signed certificate that hands
+// every accepted connection, after the login request, to the test.
+type fakeServer struct {
+	listener net.Listener
+	conns    chan net.Conn
+}
+
+func newFakeServer(t *testing.T) *fakeServer {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "snoti"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: key}},
+	})
+	assert.Nil(t, err)
+	s := &fakeServer{listener: listener, conns: make(chan net.Conn, 4)}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			if _, err = bufio.NewReader(conn).ReadString('\n'); err != nil {
+				_ = conn.Close()
+				continue
+			}
+			s.conns <- conn
+		}
+	}()
+	return s
+}
+
+func (s *fakeServer) Accept(t *testing.T) net.Conn {
+	select {
+	case conn := <-s.conns:
+		return conn
+	case <-time.After(5 * time.Second):
+		t.Fatal("no connection to the broker")
+		return nil
+	}
+}
+
+// Send writes each frame on its own, so that each goes out in its own record.
+func (s *fakeServer) Send(t *testing.T, conn net.Conn, frames ...string) {
+	for _, frame := range frames {
+		_, err := conn.Write([]byte(frame))
+		assert.Nil(t, err)
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func (s *fakeServer) Close() {
+	_ = s.listener.Close()
+}
+
+func readMessage(t *testing.T, conn Connection) *Output {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if buff := conn.Read(); buff != nil {
+			out := &Output{}
+			assert.Nil(t, json.Unmarshal(buff, out))
+			return out
+		}
+	}
+	t.Fatal("no message from the broker")
+	return nil
+}
+
+func TestConnection_Framing(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.Close()
+	conn := NewConnection(log.RootLogger(), &Settings{BrokerUrl: server.listener.Addr().String(), MaxMessageSize: 1 << 16})
+	go conn.Connect()
+
+	broker := server.Accept(t)
+	defer broker.Close()
+	large := `{"cmd":"event_push","mac":"m2","data":{"text":"` + strings.Repeat("x", 4000) + `"}}` + "\n"
+	server.Send(t, broker,
+		// The login response split, with the first message glued to it.
+		loginResponse[:10], loginResponse[10:]+`{"cmd":"event_push","mac":"m1"}`+"\n",
+		// A message larger than a read buffer, in fragments.
+		large[:1000], large[1000:3000], large[3000:],
+		// Several messages in one frame, with CRLF line endings.
+		`{"cmd":"event_push","mac":"m3"}`+"\r\n"+`{"cmd":"event_push","mac":"m4"}`+"\r\n",
+	)
+
+	assert.Equal(t, "m1", readMessage(t, conn).DeviceMac)
+	out := readMessage(t, conn)
+	assert.Equal(t, "m2", out.DeviceMac)
+	assert.Len(t, out.EventData["text"], 4000)
+	assert.Equal(t, "m3", readMessage(t, conn).DeviceMac)
+	assert.Equal(t, "m4", readMessage(t, conn).DeviceMac)
+	conn.Close()
+}
+
+func TestConnection_MaxMessageSize(t *testing.T) {
+	server := newFakeServer(t)
+	defer server.Close()
+	conn := NewConnection(log.RootLogger(), &Settings{BrokerUrl: server.listener.Addr().String(), MaxMessageSize: 1024})
+	go conn.Connect()
+
+	// A message over the limit is skipped, the ones after it still arrive
+	// on the same connection.
+	broker := server.Accept(t)
+	defer broker.Close()
+	large := `{"cmd":"event_push","mac":"` + strings.Repeat("x", 8192) + `"}` + "\n"
+	server.Send(t, broker, loginResponse, large[:5000], large[5000:]+`{"cmd":"event_push","mac":"m1"}`+"\n")
+	assert.Equal(t, "m1", readMessage(t, conn).DeviceMac)
+	server.Send(t, broker, `{"cmd":"event_push","mac":"m2"}`+"\n")
+	assert.Equal(t, "m2", readMessage(t, conn).DeviceMac)
+	conn.Close()
+
+	select {
+	case <-server.conns:
+		t.Fatal("the client reconnected")
+	default:
+	}
+}
+
+func TestLineReader(t *testing.T) {
+	lines := newLineReader(strings.NewReader("a\r\n\n"+strings.Repeat("x", 5000)+"\nbcd\nlast"), 4)
+
+	line, err := lines.ReadLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "a", string(line))
+	line, err = lines.ReadLine()
+	assert.Nil(t, err)
+	assert.Empty(t, line)
+	_, err = lines.ReadLine()
+	assert.Equal(t, errMessageTooLarge, err)
+	line, err = lines.ReadLine()
+	assert.Nil(t, err)
+	assert.Equal(t, "bcd", string(line))
+	_, err = lines.ReadLine()
+	assert.Equal(t, io.EOF, err)
+}
@@ -18,6 +18,14 @@ type Settings struct {
 	AuthSecret string `md:"authSecret,required"`
 	ProductKey string `md:"productKey,required"`
 	SubKey     string `md:"subKey,required"`
+	// Concurrency is the number of workers, defaults to GOMAXPROCS.
+	Concurrency int `md:"concurrency"`
+	// OrderedByDevice hands the messages of a device, by product key and
+	// MAC, to the same worker so that they are handled in order.
+	OrderedByDevice bool `md:"orderedByDevice"`
+	// MaxMessageSize bounds a message in bytes, defaults to 1 MiB. Larger
+	// messages are logged and dropped.
+	MaxMessageSize int `md:"maxMessageSize"`
 }
 
 type Output struct {
@@ -3,6 +3,7 @@ package snoti
 import (
 	"context"
 	"encoding/json"
+	"hash/fnv"
 	"runtime"
 	"sync"
 	"time"
@@ -35,17 +36,24 @@ func (*Factory) New(config *trigger.Config) (trigger.Trigger, error) {
 		return nil, err
 	}
 
+	if s.Concurrency <= 0 {
+		s.Concurrency = runtime.GOMAXPROCS(0)
+	}
+	if s.MaxMessageSize <= 0 {
+		s.MaxMessageSize = defaultMaxMessageSize
+	}
+
 	return &Trigger{settings: s}, nil
 }
 
 // Trigger is a kafka trigger
 type Trigger struct {
-	settings  *Settings
-	conn      Connection
-	shutdown  chan struct{}
-	messageCh chan []byte
-	handlers  []trigger.Handler
-	logger    log.Logger
+	settings *Settings
+	conn     Connection
+	shutdown chan struct{}
+	queues   []chan message
+	handlers []trigger.Handler
+	logger   log.Logger
 }
 
 // Initialize initializes the trigger
@@ -59,12 +67,21 @@ func (t *Trigger) Initialize(ctx trigger.InitContext) (err error) {
 // Start starts the kafka trigger
 func (t *Trigger) Start() error {
 	t.shutdown = make(chan struct{})
-	t.messageCh = make(chan []byte)
+	// Ordered by device, every worker takes the devices hashed to its
+	// own queue, which is buffered so that one busy device does not hold
+	// back the others right away.
+	t.queues = []chan message{make(chan message)}
+	if t.settings.OrderedByDevice {
+		t.queues = make([]chan message, t.settings.Concurrency)
+		for i := range t.queues {
+			t.queues[i] = make(chan message, 16)
+		}
+	}
 
 	go t.conn.Connect()
 	go t.receiveMessage()
-	for i := 0; i < runtime.GOMAXPROCS(0); i++ {
-		go t.handleMessage()
+	for i := 0; i < t.settings.Concurrency; i++ {
+		go t.handleMessage(t.queues[i%len(t.queues)])
 	}
 	// Waiting for ready.
 	time.Sleep(1 * time.Second)
@@ -86,23 +103,45 @@ func (t *Trigger) receiveMessage() {
 			return
 		default:
 		}
-		if buff := t.conn.Read(); buff != nil {
-			t.messageCh <- buff
+		buff := t.conn.Read()
+		if buff == nil {
+			continue
 		}
+		data := &Output{}
+		if err := json.Unmarshal(buff, data); err != nil {
+			continue
+		}
+		select {
+		case <-t.shutdown:
+			return
+		case t.worker(data) <- message{buff: buff, data: data}:
+		}
+	}
+}
+
+// message is a received message with its data.
+type message struct {
+	buff []byte
+	data *Output
+}
+
+// worker returns the queue of the worker handling the data.
+func (t *Trigger) worker(data *Output) chan message {
+	if len(t.queues) == 1 {
+		return t.queues[0]
 	}
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(data.ProductKey + "/" + data.DeviceMac))
+	return t.queues[h.Sum32()%uint32(len(t.queues))]
 }
 
-func (t *Trigger) handleMessage() {
+func (t *Trigger) handleMessage(queue chan message) {
 	for {
 		select {
 		case <-t.shutdown:
 			return
-		case buff := <-t.messageCh:
-			data := &Output{}
-			if err := json.Unmarshal(buff, data); err != nil {
-				continue
-			}
-
+		case m := <-queue:
+			buff, data := m.buff, m.data
 			var wg sync.WaitGroup
 			wg.Add(len(t.handlers))
 			for _, handler := range t.handlers {
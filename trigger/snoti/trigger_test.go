@@ -1,10 +1,15 @@
 package snoti
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/project-flogo/core/action"
+	"github.com/project-flogo/core/support/log"
 	"github.com/project-flogo/core/support/test"
 	"github.com/project-flogo/core/trigger"
 	"github.com/stretchr/testify/assert"
@@ -44,3 +49,79 @@ func TestSNotiTrigger_Initialize(t *testing.T) {
 	assert.Nil(t, err)
 
 }
+
+// fakeConnection hands queued messages to the trigger and records acks.
+type fakeConnection struct {
+	messages chan []byte
+	mu       sync.Mutex
+	acks     int
+}
+
+func (c *fakeConnection) Connect() {}
+
+func (c *fakeConnection) Close() {}
+
+func (c *fakeConnection) Read() []byte {
+	select {
+	case buff := <-c.messages:
+		return buff
+	case <-time.After(10 * time.Millisecond):
+		return nil
+	}
+}
+
+func (c *fakeConnection) Write(buff []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.acks++
+}
+
+// fakeHandler records the data of every call.
+type fakeHandler struct {
+	mu   sync.Mutex
+	data []*Output
+}
+
+func (h *fakeHandler) Name() string                     { return "fake" }
+func (h *fakeHandler) Logger() log.Logger               { return log.RootLogger() }
+func (h *fakeHandler) Settings() map[string]interface{} { return nil }
+func (h *fakeHandler) Schemas() *trigger.SchemaConfig   { return nil }
+func (h *fakeHandler) Handle(ctx context.Context, triggerData interface{}) (map[string]interface{}, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.data = append(h.data, triggerData.(*Output))
+	return nil, nil
+}
+
+func TestTrigger_OrderedByDevice(t *testing.T) {
+	conn := &fakeConnection{messages: make(chan []byte, 64)}
+	handler := &fakeHandler{}
+	trg := &Trigger{
+		settings: &Settings{Concurrency: 4, OrderedByDevice: true},
+		conn:     conn,
+		handlers: []trigger.Handler{handler},
+		logger:   log.RootLogger(),
+	}
+	for i := 0; i < 10; i++ {
+		for _, mac := range []string{"m1", "m2", "m3"} {
+			conn.messages <- []byte(fmt.Sprintf(`{"msg_id":"%s-%d","product_key":"pk","mac":%q,"data":{"seq":%d}}`, mac, i, mac, i))
+		}
+	}
+	assert.Nil(t, trg.Start())
+	defer trg.Stop()
+	assert.Len(t, trg.queues, 4)
+
+	assert.Eventually(t, func() bool {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.acks == 30
+	}, time.Second, time.Millisecond)
+
+	next := make(map[string]float64)
+	handler.mu.Lock()
+	defer handler.mu.Unlock()
+	for _, data := range handler.data {
+		assert.Equal(t, next[data.DeviceMac], data.EventData["seq"], "device %s", data.DeviceMac)
+		next[data.DeviceMac]++
+	}
+}